@@ -5,9 +5,7 @@ import (
 	"log"
 	"time"
 
-	"periph.io/x/periph/conn/i2c"
-	"periph.io/x/periph/conn/i2c/i2creg"
-	"periph.io/x/periph/host"
+	"github.com/tquellenberg/weatherstation/internal/bosch"
 )
 
 /**
@@ -15,13 +13,18 @@ import (
  * Combined temperature, humidity and pressure sensor
  * https://cdn-shop.adafruit.com/datasheets/BST-BME280_DS001-10.pdf
  *
- * Access via i2c protocoll.
+ * The BMP280 has the same registers without humidity.
+ *
+ * Access via i2c protocoll or SPI (see transport.go).
  * https://en.wikipedia.org/wiki/I%C2%B2C
 **/
 
 type BME280 struct {
-	dev *i2c.Dev
-	cv  CompensationValues
+	dev    Transport
+	chipId byte
+	cv     CompensationValues
+	// Configuration written to the chip; nil until the first SetConfiguration
+	config *Configuration
 }
 
 const (
@@ -33,11 +36,28 @@ const (
 	REG_CALIBRATION_H1 = 0xA1
 	REG_CALIBRATION_H2 = 0xE1
 	REG_RESET          = 0xE0
+	REG_STATUS         = 0xF3
 
 	CMD_RESET = 0xB6
 
-	WHO_AM_I = 0xD0
-	CHIP_ID  = 0x60
+	// Bits of the status register
+	STATUS_MEASURING = 0x08
+	STATUS_IM_UPDATE = 0x01
+
+	WHO_AM_I       = 0xD0
+	CHIP_ID        = 0x60
+	CHIP_ID_BMP280 = 0x58
+	CHIP_ID_BME680 = 0x61
+)
+
+const (
+	// The chip does not respond during its start-up after a reset (datasheet: 2 ms)
+	startupTime = 2 * time.Millisecond
+	// Time for copying the NVM data after a reset
+	resetTimeout = 100 * time.Millisecond
+	// Additional time a measurement may take longer than expected
+	measurementTimeout = 50 * time.Millisecond
+	statusPollInterval = 2 * time.Millisecond
 )
 
 type TemperatureCompensation struct {
@@ -74,126 +94,259 @@ type rawResult struct {
 	Temperature int32
 	Pressure    uint32
 	Humidity    uint32
+	TFine       int32
+	// humidity was outside of 0..100% and has been limited
+	HumidityClamped bool
 }
 
+// Optional channels of a result
+type Channels uint8
+
+const (
+	CHANNEL_HUMIDITY Channels = 1 << iota
+	CHANNEL_GAS
+)
+
 type Result struct {
 	Temperature float32
 	Pressure    float32
 	Humidity    float32
+	// Gas resistance in ohm
+	GasResistance float32
+	// Optional channels which have been measured; temperature and pressure are always present
+	Channels Channels
 }
 
-func writeReadTx(d *i2c.Dev, b byte, size int) []byte {
-	write := []byte{b}
-	read := make([]byte, size)
-	if err := d.Tx(write, read); err != nil {
-		log.Println(err)
-	}
-	return read
+// Result together with the values it was calculated from
+type Reading struct {
+	Result
+	// Uncompensated ADC values
+	RawTemperature int32
+	RawPressure    int32
+	RawHumidity    int32
+	// BME680 only: gas ADC value and range
+	RawGasResistance int32
+	GasRange         uint8
+	// Fine resolution temperature of the compensation
+	TFine int32
+	// Time of the measurement
+	Time time.Time
 }
 
-func devCheck(d *i2c.Dev) {
-	read := writeReadTx(d, WHO_AM_I, 1)
-	if read[0] == CHIP_ID {
+func (r Result) HasHumidity() bool {
+	return r.Channels&CHANNEL_HUMIDITY != 0
+}
+
+func (r Result) HasGasResistance() bool {
+	return r.Channels&CHANNEL_GAS != 0
+}
+
+func devCheck(d Transport) (byte, error) {
+	read, err := d.ReadRegisters(WHO_AM_I, 1)
+	if err != nil {
+		return 0, err
+	}
+	switch read[0] {
+	case CHIP_ID:
 		log.Printf("Device is Bme280")
-	} else {
-		log.Printf("Device is not Bme280 (%#x)", read[0])
+	case CHIP_ID_BMP280:
+		log.Printf("Device is Bmp280")
+	default:
+		return 0, &ChipIdError{ChipId: read[0]}
 	}
+	return read[0], nil
 }
 
-func reset(d *i2c.Dev) {
-	log.Println("Bme280: Reset")
-	d.Write([]byte{REG_RESET, CMD_RESET})
-	time.Sleep(2 * time.Second)
+func (d *BME280) hasHumidity() bool {
+	return d.chipId == CHIP_ID
 }
 
-// unsigned int from two bytes (little-endian)
-func uint16LE(b0 byte, b1 byte) uint16 {
-	return uint16(b1)<<8 | uint16(b0)
+// Read the chip id of the connected device
+func ReadChipId(d Transport) (byte, error) {
+	read, err := d.ReadRegisters(WHO_AM_I, 1)
+	if err != nil {
+		return 0, err
+	}
+	return read[0], nil
 }
 
-// signed int from two bytes (little-endian)
-func int16LE(b0 byte, b1 byte) int16 {
-	return int16(b1)<<8 | int16(b0)
+func reset(d Transport) error {
+	log.Println("Bme280: Reset")
+	if err := d.WriteRegister(REG_RESET, CMD_RESET); err != nil {
+		return err
+	}
+	time.Sleep(startupTime)
+	return waitForStatus(d, STATUS_IM_UPDATE, resetTimeout, "reset")
+}
+
+// Poll the status register until all bits of mask are cleared
+func waitForStatus(d Transport, mask byte, timeout time.Duration, operation string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := d.ReadRegisters(REG_STATUS, 1)
+		if err != nil {
+			return err
+		}
+		if status[0]&mask == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &TimeoutError{Operation: operation, Timeout: timeout}
+		}
+		time.Sleep(statusPollInterval)
+	}
 }
 
-func readCompensationValues(dev *i2c.Dev) CompensationValues {
+func readCompensationValues(dev Transport, withHumidity bool) (CompensationValues, error) {
 	log.Println("Bme280: Read compensation values")
 	var cv CompensationValues
 
-	read := writeReadTx(dev, REG_CALIBRATION, 24)
-	cv.temperatureCompensation.t1 = int32(uint16LE(read[0], read[1]))
-	cv.temperatureCompensation.t2 = int32(int16LE(read[2], read[3]))
-	cv.temperatureCompensation.t3 = int32(int16LE(read[4], read[5]))
-
-	cv.pressureCompensation.p1 = int32(uint16LE(read[6], read[7]))
-	cv.pressureCompensation.p2 = int32(int16LE(read[8], read[9]))
-	cv.pressureCompensation.p3 = int32(int16LE(read[10], read[11]))
-	cv.pressureCompensation.p4 = int32(int16LE(read[12], read[13]))
-	cv.pressureCompensation.p5 = int32(int16LE(read[14], read[15]))
-	cv.pressureCompensation.p6 = int32(int16LE(read[16], read[17]))
-	cv.pressureCompensation.p7 = int32(int16LE(read[18], read[19]))
-	cv.pressureCompensation.p8 = int32(int16LE(read[20], read[21]))
-	cv.pressureCompensation.p9 = int32(int16LE(read[22], read[23]))
-
-	read2 := writeReadTx(dev, REG_CALIBRATION_H1, 1)
+	read, err := dev.ReadRegisters(REG_CALIBRATION, 24)
+	if err != nil {
+		return cv, err
+	}
+	cv.temperatureCompensation.t1 = int32(bosch.Uint16LE(read[0], read[1]))
+	cv.temperatureCompensation.t2 = int32(bosch.Int16LE(read[2], read[3]))
+	cv.temperatureCompensation.t3 = int32(bosch.Int16LE(read[4], read[5]))
+
+	cv.pressureCompensation.p1 = int32(bosch.Uint16LE(read[6], read[7]))
+	cv.pressureCompensation.p2 = int32(bosch.Int16LE(read[8], read[9]))
+	cv.pressureCompensation.p3 = int32(bosch.Int16LE(read[10], read[11]))
+	cv.pressureCompensation.p4 = int32(bosch.Int16LE(read[12], read[13]))
+	cv.pressureCompensation.p5 = int32(bosch.Int16LE(read[14], read[15]))
+	cv.pressureCompensation.p6 = int32(bosch.Int16LE(read[16], read[17]))
+	cv.pressureCompensation.p7 = int32(bosch.Int16LE(read[18], read[19]))
+	cv.pressureCompensation.p8 = int32(bosch.Int16LE(read[20], read[21]))
+	cv.pressureCompensation.p9 = int32(bosch.Int16LE(read[22], read[23]))
+
+	if !withHumidity {
+		return cv, nil
+	}
+
+	read2, err := dev.ReadRegisters(REG_CALIBRATION_H1, 1)
+	if err != nil {
+		return cv, err
+	}
 	cv.humidityCompensation.h1 = int32(uint8(read2[0]))
 
-	read3 := writeReadTx(dev, REG_CALIBRATION_H2, 7)
-	cv.humidityCompensation.h2 = int32(int16LE(read3[0], read3[1]))
+	read3, err := dev.ReadRegisters(REG_CALIBRATION_H2, 7)
+	if err != nil {
+		return cv, err
+	}
+	cv.humidityCompensation.h2 = int32(bosch.Int16LE(read3[0], read3[1]))
 	cv.humidityCompensation.h3 = int32(uint8(read3[2]))
 	cv.humidityCompensation.h4 = int32((int16(read3[3]) << 4) | (int16(read3[4] & 0x0F)))
 	cv.humidityCompensation.h5 = int32((int16(read3[5]) << 4) | (int16(read3[4]) >> 4))
 	cv.humidityCompensation.h6 = int32(read3[6])
 
-	return cv
+	return cv, nil
 }
 
-func (d *BME280) SetConfiguration() {
-	log.Println("Bme280: Set configuration")
-	// oversampling humidity ×1
-	OVERSAMPLE_HUMI := 1
-	d.dev.Write([]byte{CTRL_HUMIDITY_ADDR, byte(OVERSAMPLE_HUMI)})
-
-	read := writeReadTx(d.dev, CTRL_MEAS_ADDR, 1)
-	oldSstate := read[0]
+// Write the configuration to the chip. Registers are only written if the
+// configuration differs from the one written before.
+func (d *BME280) SetConfiguration(c Configuration) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if d.config != nil && *d.config == c {
+		return nil
+	}
+	log.Printf("Bme280: Set configuration %+v", c)
 
-	// Pressure oversampling x1, Temperature oversampling x1, Forced mode
-	OVERSAMPLE_TEMP := 1
-	OVERSAMPLE_PRES := 1
-	MODE := 1
-	control := OVERSAMPLE_TEMP<<5 | OVERSAMPLE_PRES<<2 | MODE
-	d.dev.Write([]byte{CTRL_MEAS_ADDR, byte(control)})
-	writeReadTx(d.dev, CTRL_MEAS_ADDR, 1)
+	// config is only reliably written in sleep mode
+	if err := d.dev.WriteRegister(CTRL_MEAS_ADDR, c.ctrlMeas(modeSleep)); err != nil {
+		return err
+	}
+	if err := d.dev.WriteRegister(CTRL_CONFIG, c.config()); err != nil {
+		return err
+	}
+	// ctrl_hum becomes effective after writing ctrl_meas
+	if d.hasHumidity() {
+		if err := d.dev.WriteRegister(CTRL_HUMIDITY_ADDR, c.ctrlHum()); err != nil {
+			return err
+		}
+	}
+	if err := d.dev.WriteRegister(CTRL_MEAS_ADDR, c.ctrlMeas(c.modeBits())); err != nil {
+		return err
+	}
 
-	// Filter OFF
-	d.dev.Write([]byte{CTRL_CONFIG, 0x00})
+	d.config = &c
+	return nil
+}
 
-	if oldSstate == 0 {
-		time.Sleep(time.Second)
+// In forced mode a single measurement is started; the chip goes back
+// to sleep mode afterwards.
+func (d *BME280) triggerMeasurement() error {
+	if err := d.dev.WriteRegister(CTRL_MEAS_ADDR, d.config.ctrlMeas(modeForced)); err != nil {
+		return err
 	}
+	time.Sleep(d.config.MeasurementTime())
+	return waitForStatus(d.dev, STATUS_MEASURING, measurementTimeout, "measurement")
 }
 
 func (d *BME280) ReadValues() (Result, error) {
+	reading, err := d.ReadReading()
+	return reading.Result, err
+}
+
+// Read compensated values together with raw ADC values and t_fine
+func (d *BME280) ReadReading() (Reading, error) {
 	log.Println("Bme280: Read values")
-	read4 := writeReadTx(d.dev, REG_PRESSURE, 8)
+	if d.config == nil {
+		if err := d.SetConfiguration(DefaultConfiguration()); err != nil {
+			return Reading{}, err
+		}
+	}
+	if d.config.Mode == MODE_FORCED {
+		if err := d.triggerMeasurement(); err != nil {
+			return Reading{}, err
+		}
+	}
+	size := 6
+	if d.hasHumidity() {
+		size = 8
+	}
+	read4, err := d.dev.ReadRegisters(REG_PRESSURE, size)
+	if err != nil {
+		return Reading{}, err
+	}
+
+	reading := Reading{Time: time.Now()}
+	reading.RawPressure = int32((uint32(read4[0]) << 12) | (uint32(read4[1]) << 4) | (uint32(read4[2]) >> 4))
+	reading.RawTemperature = int32((uint32(read4[3]) << 12) | (uint32(read4[4]) << 4) | (uint32(read4[5]) >> 4))
+	if !d.hasHumidity() {
+		r := compensate(d.config.Compensation, d.cv, reading.RawTemperature, reading.RawPressure, 0)
+		reading.TFine = r.TFine
+		reading.Result, err = SanityCheck(toResult(r, 0))
+		return reading, err
+	}
+	reading.RawHumidity = int32((uint32(read4[6]) << 8) | uint32(read4[7]))
 
-	rawPressure := int32((uint32(read4[0]) << 12) | (uint32(read4[1]) << 4) | (uint32(read4[2]) >> 4))
-	rawTemp := int32((uint32(read4[3]) << 12) | (uint32(read4[4]) << 4) | (uint32(read4[5]) >> 4))
-	rawHumidity := int32((uint32(read4[6]) << 8) | uint32(read4[7]))
+	r := compensate(d.config.Compensation, d.cv, reading.RawTemperature, reading.RawPressure, reading.RawHumidity)
+	reading.TFine = r.TFine
+	reading.Result = toResult(r, CHANNEL_HUMIDITY)
+	if r.HumidityClamped {
+		return reading, &InvalidValueError{Channel: "humidity", Value: reading.Humidity, Reason: "compensation out of range"}
+	}
 
-	result := toResult(compensation(d.cv, rawTemp, rawPressure, rawHumidity))
+	reading.Result, err = SanityCheck(reading.Result)
+	return reading, err
+}
 
-	return sanityCheck(result)
+// Fine resolution temperature value (t_fine), input for pressure and humidity compensation
+func temperatureFine(cv CompensationValues, rawTemp int32) int32 {
+	tvar1 := ((rawTemp >> 3) - (cv.temperatureCompensation.t1 << 1)) * cv.temperatureCompensation.t2
+	tvar2 := (((rawTemp >> 4) - cv.temperatureCompensation.t1) *
+		((rawTemp >> 4) - cv.temperatureCompensation.t1) >> 12) * cv.temperatureCompensation.t3
+	return (tvar1 >> 11) + (tvar2 >> 14)
 }
 
 func compensation(cv CompensationValues, rawTemp int32, rawPressure int32, rawHumidity int32) rawResult {
 	var r rawResult
 
 	// Temperature compensation (int32)
-	tvar1 := ((rawTemp >> 3) - (cv.temperatureCompensation.t1 << 1)) * cv.temperatureCompensation.t2
-	tvar2 := (((rawTemp >> 4) - cv.temperatureCompensation.t1) *
-		((rawTemp >> 4) - cv.temperatureCompensation.t1) >> 12) * cv.temperatureCompensation.t3
-	tFine := (tvar1 >> 11) + (tvar2 >> 14)
+	tFine := temperatureFine(cv, rawTemp)
+	r.TFine = tFine
 	r.Temperature = ((tFine*5 + 128) >> 8)
 
 	// Pressure compensation (int32)
@@ -230,56 +383,93 @@ func compensation(cv CompensationValues, rawTemp int32, rawPressure int32, rawHu
 	if v_x1_u32r < 0 {
 		log.Printf("Bme280: Humidity value too small: %d\n", v_x1_u32r)
 		v_x1_u32r = 0
+		r.HumidityClamped = true
 	}
 	if v_x1_u32r > 419430400 {
 		log.Printf("Bme280: Humidity value too big: %d\n", v_x1_u32r)
 		v_x1_u32r = 419430400
+		r.HumidityClamped = true
 	}
 	r.Humidity = uint32(v_x1_u32r >> 12)
 
 	return r
 }
 
-func toResult(rawResult rawResult) (result Result) {
-	result.Temperature = float32(rawResult.Temperature) / 100.0
-	result.Humidity = float32(rawResult.Humidity) / 1024.0
-	result.Pressure = float32(rawResult.Pressure) / 100.0
+func toResult(r floatResult, channels Channels) (result Result) {
+	result.Temperature = float32(r.Temperature)
+	result.Pressure = float32(r.Pressure)
+	if channels&CHANNEL_HUMIDITY != 0 {
+		result.Humidity = float32(r.Humidity)
+	}
+	result.Channels = channels
 	return result
 }
 
-func sanityCheck(result Result) (Result, error) {
-	if result.Temperature < -100.0 || result.Temperature > 100.0 {
-		return result, fmt.Errorf("temperature out of valid range %0.2f", result.Temperature)
+// Operating range of the BME280 (datasheet table 1)
+const (
+	minTemperature = -40.0
+	maxTemperature = 85.0
+	minPressure    = 300.0
+	maxPressure    = 1100.0
+	minHumidity    = 0.0
+	maxHumidity    = 100.0
+)
+
+// Check that the values are within the operating range of the sensors
+func SanityCheck(result Result) (Result, error) {
+	if err := rangeCheck("temperature", result.Temperature, minTemperature, maxTemperature); err != nil {
+		return result, err
+	}
+	if err := rangeCheck("pressure", result.Pressure, minPressure, maxPressure); err != nil {
+		return result, err
+	}
+	if result.HasHumidity() {
+		if err := rangeCheck("humidity", result.Humidity, minHumidity, maxHumidity); err != nil {
+			return result, err
+		}
 	}
 	return result, nil
 }
 
-func InitBme280(address int) (*BME280, error) {
+func rangeCheck(channel string, value float32, min float32, max float32) error {
+	if value < min || value > max {
+		return &InvalidValueError{
+			Channel: channel,
+			Value:   value,
+			Reason:  fmt.Sprintf("out of valid range %0.2f..%0.2f", min, max)}
+	}
+	return nil
+}
+
+// Initialise the chip connected via the transport; the transport
+// is closed when the initialisation fails.
+func InitBme280(d Transport) (*BME280, error) {
 	log.Print("Bme280: Init")
 
-	// Make sure periph is initialized.
-	if _, err := host.Init(); err != nil {
+	chipId, err := devCheck(d)
+	if err != nil {
+		log.Println(err)
+		d.Close()
+		return nil, err
+	}
+	if err := reset(d); err != nil {
 		log.Println(err)
+		d.Close()
 		return nil, err
 	}
-	log.Print("Bme280: Host okay")
 
-	// Use i2creg I²C bus registry to find the first available I²C bus.
-	b, err := i2creg.Open("")
+	compensationValues, err := readCompensationValues(d, chipId == CHIP_ID)
 	if err != nil {
 		log.Println(err)
+		d.Close()
 		return nil, err
 	}
-	log.Print("Bme280: I2C okay")
-	// defer b.Close()
-
-	// Dev is a valid conn.Conn.
-	d := &i2c.Dev{Addr: uint16(address), Bus: b}
 
-	devCheck(d)
-	reset(d)
-
-	compensationValues := readCompensationValues(d)
+	return &BME280{dev: d, chipId: chipId, cv: compensationValues}, nil
+}
 
-	return &BME280{d, compensationValues}, nil
+// Release the bus
+func (d *BME280) Close() error {
+	log.Print("Bme280: Close")
+	return d.dev.Close()
 }
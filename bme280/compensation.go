@@ -0,0 +1,121 @@
+package bme280
+
+/**
+ * Alternative compensation formulas from the datasheet (chapter 8):
+ * 64 bit integer pressure compensation and double precision
+ * floating point compensation for all channels.
+**/
+
+const (
+	COMPENSATION_INT32 = "int32"
+	COMPENSATION_INT64 = "int64"
+	COMPENSATION_FLOAT = "float"
+)
+
+// Compensated values in degrees Celsius, hectopascal and percent
+type floatResult struct {
+	Temperature float64
+	Pressure    float64
+	Humidity    float64
+	TFine       int32
+	// humidity was outside of 0..100% and has been limited
+	HumidityClamped bool
+}
+
+func compensate(mode string, cv CompensationValues, rawTemp int32, rawPressure int32, rawHumidity int32) floatResult {
+	switch mode {
+	case COMPENSATION_INT64:
+		return compensation64(cv, rawTemp, rawPressure, rawHumidity)
+	case COMPENSATION_FLOAT:
+		return compensationFloat(cv, rawTemp, rawPressure, rawHumidity)
+	default:
+		return compensation(cv, rawTemp, rawPressure, rawHumidity).toFloat()
+	}
+}
+
+func (r rawResult) toFloat() floatResult {
+	return floatResult{
+		Temperature:     float64(r.Temperature) / 100.0,
+		Pressure:        float64(r.Pressure) / 100.0,
+		Humidity:        float64(r.Humidity) / 1024.0,
+		TFine:           r.TFine,
+		HumidityClamped: r.HumidityClamped,
+	}
+}
+
+// Temperature and humidity as int32, pressure as int64
+func compensation64(cv CompensationValues, rawTemp int32, rawPressure int32, rawHumidity int32) floatResult {
+	r := compensation(cv, rawTemp, rawPressure, rawHumidity).toFloat()
+	// Pressure in Pa as unsigned 32 bit integer in Q24.8 format
+	r.Pressure = float64(pressure64(cv, temperatureFine(cv, rawTemp), rawPressure)) / 256.0 / 100.0
+	return r
+}
+
+func pressure64(cv CompensationValues, tFine int32, rawPressure int32) uint32 {
+	pc := cv.pressureCompensation
+	var1 := int64(tFine) - 128000
+	var2 := var1 * var1 * int64(pc.p6)
+	var2 = var2 + ((var1 * int64(pc.p5)) << 17)
+	var2 = var2 + (int64(pc.p4) << 35)
+	var1 = ((var1 * var1 * int64(pc.p3)) >> 8) + ((var1 * int64(pc.p2)) << 12)
+	var1 = (((int64(1) << 47) + var1) * int64(pc.p1)) >> 33
+	if var1 == 0 {
+		return 0 // avoid exception caused by division by zero
+	}
+	p := int64(1048576 - rawPressure)
+	p = (((p << 31) - var2) * 3125) / var1
+	var1 = (int64(pc.p9) * (p >> 13) * (p >> 13)) >> 25
+	var2 = (int64(pc.p8) * p) >> 19
+	p = ((p + var1 + var2) >> 8) + (int64(pc.p7) << 4)
+	return uint32(p)
+}
+
+// Double precision floating point formulas
+func compensationFloat(cv CompensationValues, rawTemp int32, rawPressure int32, rawHumidity int32) floatResult {
+	var r floatResult
+	tc := cv.temperatureCompensation
+	pc := cv.pressureCompensation
+	hc := cv.humidityCompensation
+
+	// Temperature
+	var1 := (float64(rawTemp)/16384.0 - float64(tc.t1)/1024.0) * float64(tc.t2)
+	var2 := (float64(rawTemp)/131072.0 - float64(tc.t1)/8192.0) *
+		(float64(rawTemp)/131072.0 - float64(tc.t1)/8192.0) * float64(tc.t3)
+	r.TFine = int32(var1 + var2)
+	tFine := float64(r.TFine)
+	r.Temperature = (var1 + var2) / 5120.0
+
+	// Pressure
+	var1 = tFine/2.0 - 64000.0
+	var2 = var1 * var1 * float64(pc.p6) / 32768.0
+	var2 = var2 + var1*float64(pc.p5)*2.0
+	var2 = var2/4.0 + float64(pc.p4)*65536.0
+	var1 = (float64(pc.p3)*var1*var1/524288.0 + float64(pc.p2)*var1) / 524288.0
+	var1 = (1.0 + var1/32768.0) * float64(pc.p1)
+	if var1 == 0.0 {
+		r.Pressure = 0 // avoid exception caused by division by zero
+	} else {
+		p := 1048576.0 - float64(rawPressure)
+		p = (p - var2/4096.0) * 6250.0 / var1
+		var1 = float64(pc.p9) * p * p / 2147483648.0
+		var2 = p * float64(pc.p8) / 32768.0
+		p = p + (var1+var2+float64(pc.p7))/16.0
+		r.Pressure = p / 100.0
+	}
+
+	// Humidity
+	h := tFine - 76800.0
+	h = (float64(rawHumidity) - (float64(hc.h4)*64.0 + float64(hc.h5)/16384.0*h)) *
+		(float64(hc.h2) / 65536.0 * (1.0 + float64(hc.h6)/67108864.0*h*(1.0+float64(hc.h3)/67108864.0*h)))
+	h = h * (1.0 - float64(hc.h1)*h/524288.0)
+	if h > 100.0 {
+		h = 100.0
+		r.HumidityClamped = true
+	} else if h < 0.0 {
+		h = 0.0
+		r.HumidityClamped = true
+	}
+	r.Humidity = h
+
+	return r
+}
@@ -0,0 +1,47 @@
+package bme280
+
+import (
+	"math"
+	"testing"
+)
+
+// Calibration and ADC values of the compensation example in the BMP280 datasheet
+var datasheetCalibration = CompensationValues{
+	temperatureCompensation: TemperatureCompensation{t1: 27504, t2: 26435, t3: -1000},
+	pressureCompensation: PressureCompensation{p1: 36477, p2: -10685, p3: 3024, p4: 2855,
+		p5: 140, p6: -7, p7: 15500, p8: -14600, p9: 6000},
+}
+
+const (
+	datasheetRawTemperature = 519888
+	datasheetRawPressure    = 415148
+)
+
+func TestCompensationDatasheetExample(t *testing.T) {
+	tests := []struct {
+		mode string
+		// degrees Celsius and pascal
+		temperature float64
+		pressure    float64
+		tolerance   float64
+	}{
+		// the 32 bit formula is less accurate than the others
+		{COMPENSATION_INT32, 25.08, 100656, 0.5},
+		{COMPENSATION_INT64, 25.08, 100653.27, 0.5},
+		{COMPENSATION_FLOAT, 25.08, 100653.27, 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			r := compensate(test.mode, datasheetCalibration, datasheetRawTemperature, datasheetRawPressure, 0)
+			if math.Abs(r.Temperature-test.temperature) > 0.01 {
+				t.Errorf("temperature %.4f, expected %.2f", r.Temperature, test.temperature)
+			}
+			if pressure := r.Pressure * 100; math.Abs(pressure-test.pressure) > test.tolerance {
+				t.Errorf("pressure %.2f Pa, expected %.2f Pa", pressure, test.pressure)
+			}
+			if r.TFine != 128422 {
+				t.Errorf("t_fine %d, expected 128422", r.TFine)
+			}
+		})
+	}
+}
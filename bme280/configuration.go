@@ -0,0 +1,122 @@
+package bme280
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/internal/bosch"
+)
+
+/**
+ * Measurement settings of the BME280 (datasheet chapter 3 and 5.4).
+**/
+
+const (
+	MODE_FORCED = "forced"
+	MODE_NORMAL = "normal"
+)
+
+type Configuration struct {
+	// Oversampling per channel: 0 (skipped), 1, 2, 4, 8 or 16
+	OversamplingTemperature int `yaml:"oversamplingTemperature"`
+	OversamplingPressure    int `yaml:"oversamplingPressure"`
+	OversamplingHumidity    int `yaml:"oversamplingHumidity"`
+	// IIR filter coefficient: 0 (off), 2, 4, 8 or 16
+	Filter int `yaml:"filter"`
+	// Inactive duration between two measurements in normal mode in ms:
+	// 0.5, 10, 20, 62.5, 125, 250, 500 or 1000
+	StandbyTime float64 `yaml:"standbyTime"`
+	// "forced" (one measurement per read) or "normal" (continuous measurements)
+	Mode string `yaml:"mode"`
+	// Compensation formulas: "int32", "int64" (more precise pressure) or "float"
+	Compensation string `yaml:"compensation"`
+}
+
+// Register values for t_sb
+var standbyBits = map[float64]byte{0.5: 0, 62.5: 1, 125: 2, 250: 3, 500: 4, 1000: 5, 10: 6, 20: 7}
+
+// Register values for the sensor mode
+const (
+	modeSleep  = 0
+	modeForced = 1
+	modeNormal = 3
+)
+
+// Oversampling x1 for all channels, filter off, forced mode
+func DefaultConfiguration() Configuration {
+	return Configuration{
+		OversamplingTemperature: 1,
+		OversamplingPressure:    1,
+		OversamplingHumidity:    1,
+		Filter:                  0,
+		StandbyTime:             0.5,
+		Mode:                    MODE_FORCED,
+		Compensation:            COMPENSATION_INT32,
+	}
+}
+
+func (c Configuration) Validate() error {
+	if _, ok := bosch.OversamplingBits[c.OversamplingTemperature]; !ok {
+		return fmt.Errorf("invalid temperature oversampling %d", c.OversamplingTemperature)
+	}
+	if _, ok := bosch.OversamplingBits[c.OversamplingPressure]; !ok {
+		return fmt.Errorf("invalid pressure oversampling %d", c.OversamplingPressure)
+	}
+	if _, ok := bosch.OversamplingBits[c.OversamplingHumidity]; !ok {
+		return fmt.Errorf("invalid humidity oversampling %d", c.OversamplingHumidity)
+	}
+	if _, ok := bosch.FilterBits[c.Filter]; !ok {
+		return fmt.Errorf("invalid filter coefficient %d", c.Filter)
+	}
+	if _, ok := standbyBits[c.StandbyTime]; !ok {
+		return fmt.Errorf("invalid standby time %v ms", c.StandbyTime)
+	}
+	if c.Mode != MODE_FORCED && c.Mode != MODE_NORMAL {
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+	switch c.Compensation {
+	case "", COMPENSATION_INT32, COMPENSATION_INT64, COMPENSATION_FLOAT:
+	default:
+		return fmt.Errorf("invalid compensation %q", c.Compensation)
+	}
+	return nil
+}
+
+// Mode of ctrl_meas after configuration; in forced mode the sensor sleeps
+// until a measurement is started
+func (c Configuration) modeBits() byte {
+	if c.Mode == MODE_NORMAL {
+		return modeNormal
+	}
+	return modeSleep
+}
+
+// Content of register ctrl_hum (0xF2)
+func (c Configuration) ctrlHum() byte {
+	return bosch.OversamplingBits[c.OversamplingHumidity]
+}
+
+// Content of register ctrl_meas (0xF4) with the given mode
+func (c Configuration) ctrlMeas(mode byte) byte {
+	return bosch.OversamplingBits[c.OversamplingTemperature]<<5 | bosch.OversamplingBits[c.OversamplingPressure]<<2 | mode
+}
+
+// Content of register config (0xF5)
+func (c Configuration) config() byte {
+	return standbyBits[c.StandbyTime]<<5 | bosch.FilterBits[c.Filter]<<2
+}
+
+// Maximum duration of one measurement cycle (datasheet 9.1)
+func (c Configuration) MeasurementTime() time.Duration {
+	us := 1250.0
+	if c.OversamplingTemperature > 0 {
+		us += 2300.0 * float64(c.OversamplingTemperature)
+	}
+	if c.OversamplingPressure > 0 {
+		us += 2300.0*float64(c.OversamplingPressure) + 575.0
+	}
+	if c.OversamplingHumidity > 0 {
+		us += 2300.0*float64(c.OversamplingHumidity) + 575.0
+	}
+	return time.Duration(us) * time.Microsecond
+}
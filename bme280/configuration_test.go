@@ -0,0 +1,88 @@
+package bme280
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigurationValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+		valid  bool
+	}{
+		{"default", func(c *Configuration) {}, true},
+		{"oversampling x16", func(c *Configuration) { c.OversamplingPressure = 16 }, true},
+		{"humidity skipped", func(c *Configuration) { c.OversamplingHumidity = 0 }, true},
+		{"normal mode", func(c *Configuration) { c.Mode = MODE_NORMAL; c.StandbyTime = 62.5 }, true},
+		{"filter 16", func(c *Configuration) { c.Filter = 16 }, true},
+		{"no compensation", func(c *Configuration) { c.Compensation = "" }, true},
+		{"float compensation", func(c *Configuration) { c.Compensation = COMPENSATION_FLOAT }, true},
+		{"temperature oversampling 3", func(c *Configuration) { c.OversamplingTemperature = 3 }, false},
+		{"pressure oversampling 32", func(c *Configuration) { c.OversamplingPressure = 32 }, false},
+		{"negative humidity oversampling", func(c *Configuration) { c.OversamplingHumidity = -1 }, false},
+		{"filter 1", func(c *Configuration) { c.Filter = 1 }, false},
+		{"standby time 100", func(c *Configuration) { c.StandbyTime = 100 }, false},
+		{"empty mode", func(c *Configuration) { c.Mode = "" }, false},
+		{"sleep mode", func(c *Configuration) { c.Mode = "sleep" }, false},
+		{"compensation int16", func(c *Configuration) { c.Compensation = "int16" }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := DefaultConfiguration()
+			test.modify(&c)
+			if err := c.Validate(); (err == nil) != test.valid {
+				t.Errorf("error %v, expected valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+// Register contents of datasheet chapter 5.4
+func TestConfigurationRegisters(t *testing.T) {
+	c := Configuration{
+		OversamplingTemperature: 2,
+		OversamplingPressure:    16,
+		OversamplingHumidity:    1,
+		Filter:                  4,
+		StandbyTime:             1000,
+		Mode:                    MODE_NORMAL,
+		Compensation:            COMPENSATION_INT64,
+	}
+	if v := c.ctrlHum(); v != 0x01 {
+		t.Errorf("ctrl_hum %#x, expected 0x01", v)
+	}
+	// osrs_t 010, osrs_p 101, mode 11
+	if v := c.ctrlMeas(c.modeBits()); v != 0x57 {
+		t.Errorf("ctrl_meas %#x, expected 0x57", v)
+	}
+	// t_sb 101, filter 010
+	if v := c.config(); v != 0xA8 {
+		t.Errorf("config %#x, expected 0xa8", v)
+	}
+	// forced mode sleeps until a measurement is started
+	c.Mode = MODE_FORCED
+	if v := c.ctrlMeas(c.modeBits()); v != 0x54 {
+		t.Errorf("ctrl_meas in forced mode %#x, expected 0x54", v)
+	}
+}
+
+// Datasheet chapter 9.1: 1.25 ms + 2.3 ms per temperature sample and
+// 2.3 ms + 0.575 ms per pressure and humidity sample
+func TestMeasurementTime(t *testing.T) {
+	tests := []struct {
+		temperature, pressure, humidity int
+		expected                        time.Duration
+	}{
+		{1, 1, 1, 9300 * time.Microsecond},
+		{1, 0, 0, 3550 * time.Microsecond},
+		{16, 16, 16, 112800 * time.Microsecond},
+	}
+	for _, test := range tests {
+		c := DefaultConfiguration()
+		c.OversamplingTemperature, c.OversamplingPressure, c.OversamplingHumidity = test.temperature, test.pressure, test.humidity
+		if d := c.MeasurementTime(); d != test.expected {
+			t.Errorf("oversampling %d/%d/%d: %v, expected %v", test.temperature, test.pressure, test.humidity, d, test.expected)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package bme280
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Register dumps for debugging: the calibration, control and data
+ * registers of a chip are written to a text file ("register value" in
+ * hex per line) and can be fed back into the driver by the replay
+ * transport, without the chip.
+**/
+
+type Dump map[byte]byte
+
+// Register ranges of a dump: start and size
+var dumpRanges = [][2]int{
+	{REG_CALIBRATION, 26},   // 0x88..0xA1 temperature, pressure, H1
+	{WHO_AM_I, 1},           // chip id
+	{REG_CALIBRATION_H2, 7}, // 0xE1..0xE7 humidity
+	{CTRL_HUMIDITY_ADDR, 4}, // 0xF2..0xF5 ctrl_hum, status, ctrl_meas, config
+	{REG_PRESSURE, 8},       // 0xF7..0xFE raw ADC values
+}
+
+// Read all registers of a dump from the chip
+func ReadDump(t Transport) (Dump, error) {
+	d := make(Dump)
+	for _, r := range dumpRanges {
+		read, err := t.ReadRegisters(byte(r[0]), r[1])
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range read {
+			d[byte(r[0]+i)] = v
+		}
+	}
+	return d, nil
+}
+
+// Registers of the chip after a measurement with the current configuration
+func (d *BME280) Dump() (Dump, error) {
+	if _, err := d.ReadValues(); err != nil {
+		log.Printf("Bme280: Dump after failed measurement: %v", err)
+	}
+	return ReadDump(d.dev)
+}
+
+func (d Dump) Write(w io.Writer) error {
+	registers := make([]int, 0, len(d))
+	for r := range d {
+		registers = append(registers, int(r))
+	}
+	sort.Ints(registers)
+	if _, err := fmt.Fprintf(w, "# bme280 register dump %s\n", time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	for _, r := range registers {
+		if _, err := fmt.Fprintf(w, "0x%02x 0x%02x\n", r, d[byte(r)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Dump) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = d.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func ReadDumpFrom(r io.Reader) (Dump, error) {
+	d := make(Dump)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: register and value expected", lineNumber)
+		}
+		register, err := strconv.ParseUint(fields[0], 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		value, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		d[byte(register)] = byte(value)
+	}
+	return d, scanner.Err()
+}
+
+func ReadDumpFile(filename string) (Dump, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadDumpFrom(f)
+}
+
+// Transport which answers register reads from a dump. Writes are kept,
+// a reset is ignored and the chip never reports an ongoing measurement.
+type replayTransport struct {
+	registers Dump
+}
+
+func NewReplayTransport(d Dump) Transport {
+	registers := make(Dump, len(d))
+	for r, v := range d {
+		registers[r] = v
+	}
+	return &replayTransport{registers: registers}
+}
+
+func OpenReplay(filename string) (Transport, error) {
+	d, err := ReadDumpFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Replay: Opened %s", filename)
+	return NewReplayTransport(d), nil
+}
+
+func (t *replayTransport) ReadRegisters(register byte, size int) ([]byte, error) {
+	read := make([]byte, size)
+	for i := range read {
+		r := register + byte(i)
+		if r == REG_STATUS {
+			continue
+		}
+		v, ok := t.registers[r]
+		if !ok {
+			return nil, &BusError{Operation: "read", Register: r, Err: fmt.Errorf("not in dump")}
+		}
+		read[i] = v
+	}
+	return read, nil
+}
+
+func (t *replayTransport) WriteRegister(register byte, value byte) error {
+	if register != REG_RESET {
+		t.registers[register] = value
+	}
+	return nil
+}
+
+func (t *replayTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package bme280
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// Register dump with the calibration and ADC values of the datasheet
+// example and the humidity calibration of a BME280
+const datasheetDump = "testdata/datasheet.dump"
+
+func TestReplayDump(t *testing.T) {
+	dump, err := ReadDumpFile(datasheetDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := InitBme280(NewReplayTransport(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if !d.hasHumidity() {
+		t.Fatalf("chip id %#x, expected a BME280", d.chipId)
+	}
+	if err = d.SetConfiguration(DefaultConfiguration()); err != nil {
+		t.Fatal(err)
+	}
+	reading, err := d.ReadReading()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.RawTemperature != datasheetRawTemperature || reading.RawPressure != datasheetRawPressure || reading.RawHumidity != 27136 {
+		t.Errorf("raw values %d, %d, %d", reading.RawTemperature, reading.RawPressure, reading.RawHumidity)
+	}
+	tests := []struct {
+		channel  string
+		value    float32
+		expected float64
+	}{
+		{"temperature", reading.Temperature, 25.08},
+		// int32 compensation of the default configuration
+		{"pressure", reading.Pressure, 1006.56},
+		{"humidity", reading.Humidity, 39.03},
+	}
+	for _, test := range tests {
+		if math.Abs(float64(test.value)-test.expected) > 0.005 {
+			t.Errorf("%s %.3f, expected %.2f", test.channel, test.value, test.expected)
+		}
+	}
+	if !reading.HasHumidity() {
+		t.Error("no humidity channel")
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	dump, err := ReadDumpFile(datasheetDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = dump.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadDumpFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(dump) {
+		t.Fatalf("%d registers, expected %d", len(read), len(dump))
+	}
+	for r, v := range dump {
+		if read[r] != v {
+			t.Errorf("register %#x: %#x, expected %#x", r, read[r], v)
+		}
+	}
+}
+
+func TestReplayMissingRegister(t *testing.T) {
+	_, err := InitBme280(NewReplayTransport(Dump{WHO_AM_I: CHIP_ID}))
+	if !IsDeviceError(err) {
+		t.Errorf("error %v, expected a device error", err)
+	}
+}
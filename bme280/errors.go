@@ -0,0 +1,66 @@
+package bme280
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reading or writing a register failed on the bus
+type BusError struct {
+	Operation string
+	Register  byte
+	Err       error
+}
+
+func (e *BusError) Error() string {
+	return fmt.Sprintf("bme280: %s register %#x: %v", e.Operation, e.Register, e.Err)
+}
+
+func (e *BusError) Unwrap() error {
+	return e.Err
+}
+
+// The device at the address is not a supported sensor
+type ChipIdError struct {
+	ChipId byte
+}
+
+func (e *ChipIdError) Error() string {
+	return fmt.Sprintf("bme280: unexpected chip id %#x (supported: %#x BME280, %#x BMP280, %#x BME680)",
+		e.ChipId, CHIP_ID, CHIP_ID_BMP280, CHIP_ID_BME680)
+}
+
+// The chip did not finish an operation in time
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("bme280: %s not finished within %v", e.Operation, e.Timeout)
+}
+
+// The chip was not initialised, e.g. because it did not respond at startup
+var ErrNotInitialized = errors.New("bme280: sensor not initialized")
+
+// True if the error is caused by the communication with the chip and not
+// by implausible measured values
+func IsDeviceError(err error) bool {
+	var busError *BusError
+	var chipIdError *ChipIdError
+	var timeoutError *TimeoutError
+	return errors.As(err, &busError) || errors.As(err, &chipIdError) || errors.As(err, &timeoutError) ||
+		errors.Is(err, ErrNotInitialized)
+}
+
+// A measured value is not plausible
+type InvalidValueError struct {
+	Channel string
+	Value   float32
+	Reason  string
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("%s %0.2f rejected: %s", e.Channel, e.Value, e.Reason)
+}
@@ -0,0 +1,61 @@
+package bme280
+
+import (
+	"log"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/host"
+)
+
+// Device found on the I2C bus
+type ScanResult struct {
+	Address int
+	ChipId  byte
+	// Empty for unsupported chips
+	ChipName string
+}
+
+// Valid 7 bit addresses without reserved ones
+const (
+	firstI2cAddress = 0x03
+	lastI2cAddress  = 0x77
+)
+
+func ChipName(chipId byte) string {
+	switch chipId {
+	case CHIP_ID:
+		return "BME280"
+	case CHIP_ID_BMP280:
+		return "BMP280"
+	case CHIP_ID_BME680:
+		return "BME680"
+	}
+	return ""
+}
+
+// Probe all addresses of the I2C bus and read the chip id of
+// every device which answers
+func Scan(bus string) ([]ScanResult, error) {
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+	b, err := i2creg.Open(bus)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	log.Printf("I2C: Scanning %s", b)
+
+	result := make([]ScanResult, 0)
+	for address := firstI2cAddress; address <= lastI2cAddress; address++ {
+		d := &i2c.Dev{Addr: uint16(address), Bus: b}
+		read := make([]byte, 1)
+		if err := d.Tx([]byte{WHO_AM_I}, read); err != nil {
+			// no device at this address
+			continue
+		}
+		result = append(result, ScanResult{Address: address, ChipId: read[0], ChipName: ChipName(read[0])})
+	}
+	return result, nil
+}
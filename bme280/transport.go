@@ -0,0 +1,174 @@
+package bme280
+
+import (
+	"fmt"
+	"log"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/conn/spi/spireg"
+	"periph.io/x/periph/host"
+)
+
+/**
+ * Register access to the chip, either via I2C or via SPI (4-wire).
+**/
+
+type Transport interface {
+	// Read size bytes starting at register
+	ReadRegisters(register byte, size int) ([]byte, error)
+	WriteRegister(register byte, value byte) error
+	Close() error
+}
+
+const (
+	TRANSPORT_I2C = "i2c"
+	TRANSPORT_SPI = "spi"
+	// Register values from a dump file instead of a chip
+	TRANSPORT_REPLAY = "replay"
+)
+
+// Default SPI clock (the chip supports up to 10 MHz)
+const DEFAULT_SPI_CLOCK_SPEED = 1000000
+
+type SpiConfig struct {
+	// Bus name like "SPI0"; empty for the first available bus
+	Bus string `yaml:"bus"`
+	// Chip select of the bus; requires Bus
+	ChipSelect int `yaml:"chipSelect"`
+	// Clock speed in Hz
+	ClockSpeed int64 `yaml:"clockSpeed"`
+}
+
+type TransportConfig struct {
+	// "i2c" (default), "spi" or "replay"
+	Transport string `yaml:"transport"`
+	// I2C bus name or number like "1" or "I2C1"; empty for the first available bus
+	I2cBus     string    `yaml:"i2cbus"`
+	I2cAddress int       `yaml:"i2caddress"`
+	Spi        SpiConfig `yaml:"spi"`
+	// Register dump for transport "replay"
+	ReplayFile string `yaml:"replayFile"`
+}
+
+func (c TransportConfig) Validate() error {
+	switch c.Transport {
+	case "", TRANSPORT_I2C:
+		return nil
+	case TRANSPORT_SPI:
+		if c.Spi.ChipSelect < 0 {
+			return fmt.Errorf("invalid spi chipSelect %d", c.Spi.ChipSelect)
+		}
+		// the first available bus is opened with its default chip select
+		if c.Spi.ChipSelect != 0 && c.Spi.Bus == "" {
+			return fmt.Errorf("spi chipSelect %d needs a bus", c.Spi.ChipSelect)
+		}
+		return nil
+	case TRANSPORT_REPLAY:
+		if c.ReplayFile == "" {
+			return fmt.Errorf("transport replay needs a replayFile")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid transport %q", c.Transport)
+	}
+}
+
+func (c TransportConfig) Open() (Transport, error) {
+	if c.Transport == TRANSPORT_REPLAY {
+		return OpenReplay(c.ReplayFile)
+	}
+	// Make sure periph is initialized.
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+	if c.Transport == TRANSPORT_SPI {
+		return OpenSpi(c.Spi)
+	}
+	return OpenI2c(c.I2cBus, c.I2cAddress)
+}
+
+type i2cTransport struct {
+	bus i2c.BusCloser
+	dev *i2c.Dev
+}
+
+func OpenI2c(bus string, address int) (Transport, error) {
+	// Use i2creg I²C bus registry to find the bus; "" is the first available I²C bus.
+	b, err := i2creg.Open(bus)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("I2C: Opened %s, address %#x", b, address)
+	return &i2cTransport{bus: b, dev: &i2c.Dev{Addr: uint16(address), Bus: b}}, nil
+}
+
+func (t *i2cTransport) ReadRegisters(register byte, size int) ([]byte, error) {
+	read := make([]byte, size)
+	if err := t.dev.Tx([]byte{register}, read); err != nil {
+		return nil, &BusError{Operation: "read", Register: register, Err: err}
+	}
+	return read, nil
+}
+
+func (t *i2cTransport) WriteRegister(register byte, value byte) error {
+	if _, err := t.dev.Write([]byte{register, value}); err != nil {
+		return &BusError{Operation: "write", Register: register, Err: err}
+	}
+	return nil
+}
+
+func (t *i2cTransport) Close() error {
+	return t.bus.Close()
+}
+
+type spiTransport struct {
+	port spi.PortCloser
+	conn spi.Conn
+}
+
+func OpenSpi(c SpiConfig) (Transport, error) {
+	name := ""
+	if c.Bus != "" {
+		name = fmt.Sprintf("%s.%d", c.Bus, c.ChipSelect)
+	}
+	p, err := spireg.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	clockSpeed := c.ClockSpeed
+	if clockSpeed == 0 {
+		clockSpeed = DEFAULT_SPI_CLOCK_SPEED
+	}
+	conn, err := p.Connect(physic.Frequency(clockSpeed)*physic.Hertz, spi.Mode0, 8)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	log.Printf("SPI: Opened %s with %d Hz", p, clockSpeed)
+	return &spiTransport{port: p, conn: conn}, nil
+}
+
+// In SPI mode bit 7 of the register address selects read (1) or write (0)
+func (t *spiTransport) ReadRegisters(register byte, size int) ([]byte, error) {
+	write := make([]byte, size+1)
+	write[0] = register | 0x80
+	read := make([]byte, size+1)
+	if err := t.conn.Tx(write, read); err != nil {
+		return nil, &BusError{Operation: "read", Register: register, Err: err}
+	}
+	return read[1:], nil
+}
+
+func (t *spiTransport) WriteRegister(register byte, value byte) error {
+	if err := t.conn.Tx([]byte{register & 0x7F, value}, make([]byte, 2)); err != nil {
+		return &BusError{Operation: "write", Register: register, Err: err}
+	}
+	return nil
+}
+
+func (t *spiTransport) Close() error {
+	return t.port.Close()
+}
@@ -0,0 +1,28 @@
+package bme280
+
+import "testing"
+
+func TestTransportConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TransportConfig
+		valid  bool
+	}{
+		{"default", TransportConfig{}, true},
+		{"i2c", TransportConfig{Transport: TRANSPORT_I2C, I2cBus: "1", I2cAddress: 0x76}, true},
+		{"spi on the first bus", TransportConfig{Transport: TRANSPORT_SPI}, true},
+		{"spi chip select", TransportConfig{Transport: TRANSPORT_SPI, Spi: SpiConfig{Bus: "SPI0", ChipSelect: 1}}, true},
+		{"spi chip select without bus", TransportConfig{Transport: TRANSPORT_SPI, Spi: SpiConfig{ChipSelect: 1}}, false},
+		{"spi negative chip select", TransportConfig{Transport: TRANSPORT_SPI, Spi: SpiConfig{Bus: "SPI0", ChipSelect: -1}}, false},
+		{"replay", TransportConfig{Transport: TRANSPORT_REPLAY, ReplayFile: "bme280.dump"}, true},
+		{"replay without file", TransportConfig{Transport: TRANSPORT_REPLAY}, false},
+		{"unknown transport", TransportConfig{Transport: "usb"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.config.Validate(); (err == nil) != test.valid {
+				t.Errorf("error %v, expected valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package bme680
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+	"github.com/tquellenberg/weatherstation/internal/bosch"
+)
+
+/**
+ * BME680 / Bosch Sensortec
+ * Combined temperature, humidity, pressure and gas sensor
+ * https://www.bosch-sensortec.com/media/boschsensortec/downloads/datasheets/bst-bme680-ds001.pdf
+ *
+ * Only forced mode with a single heater profile and access via I2C
+ * are supported; SPI would need register page switching.
+ * Oversampling and filter settings are shared with the BME280.
+**/
+
+type BME680 struct {
+	dev    bme280.Transport
+	cv     CompensationValues
+	config bme280.Configuration
+}
+
+const (
+	REG_CTRL_GAS_0   = 0x70
+	REG_CTRL_GAS_1   = 0x71
+	REG_CTRL_HUM     = 0x72
+	REG_CTRL_MEAS    = 0x74
+	REG_CONFIG       = 0x75
+	REG_GAS_WAIT_0   = 0x64
+	REG_RES_HEAT_0   = 0x5A
+	REG_MEAS_STATUS  = 0x1D
+	REG_COEFF_1      = 0x89
+	REG_COEFF_2      = 0xE1
+	REG_RES_HEAT_VAL = 0x00
+	REG_RES_HEAT_RNG = 0x02
+	REG_RANGE_SW_ERR = 0x04
+	REG_RESET        = 0xE0
+
+	CMD_RESET = 0xB6
+
+	WHO_AM_I = 0xD0
+	CHIP_ID  = 0x61
+
+	// Bits of meas_status_0
+	STATUS_NEW_DATA = 0x80
+	// Bits of gas_r_lsb
+	GAS_VALID   = 0x20
+	HEAT_STABLE = 0x10
+	// Bit of ctrl_gas_1
+	RUN_GAS = 0x10
+
+	MODE_FORCED = 0x01
+)
+
+const (
+	coeff1Size = 25
+	coeff2Size = 16
+	// meas_status_0 up to gas_r_lsb
+	dataSize = 15
+	// Heater profile: target temperature in °C and duration in ms
+	heaterTemp = 320
+	heaterTime = 150
+)
+
+const resetDuration = 10 * time.Millisecond
+
+// Time for one measurement including heating of the gas sensor
+const measurementTimeout = 500 * time.Millisecond
+
+const statusPollInterval = 5 * time.Millisecond
+
+type CompensationValues struct {
+	t1                                         float64
+	t2, t3                                     float64
+	p1, p2, p3, p4, p5, p6, p7, p8, p9, p10    float64
+	h1, h2, h3, h4, h5, h6, h7                 float64
+	gh1, gh2, gh3                              float64
+	resHeatRange, resHeatVal, rangeSwitchError float64
+}
+
+func devCheck(d bme280.Transport) error {
+	read, err := d.ReadRegisters(WHO_AM_I, 1)
+	if err != nil {
+		return err
+	}
+	if read[0] != CHIP_ID {
+		return &bme280.ChipIdError{ChipId: read[0]}
+	}
+	log.Printf("Device is Bme680")
+	return nil
+}
+
+func reset(d bme280.Transport) error {
+	log.Println("Bme680: Reset")
+	if err := d.WriteRegister(REG_RESET, CMD_RESET); err != nil {
+		return err
+	}
+	time.Sleep(resetDuration)
+	return nil
+}
+
+func readCompensationValues(dev bme280.Transport) (CompensationValues, error) {
+	log.Println("Bme680: Read compensation values")
+	var cv CompensationValues
+
+	c1, err := dev.ReadRegisters(REG_COEFF_1, coeff1Size)
+	if err != nil {
+		return cv, err
+	}
+	c2, err := dev.ReadRegisters(REG_COEFF_2, coeff2Size)
+	if err != nil {
+		return cv, err
+	}
+	cv.t2 = float64(bosch.Int16LE(c1[1], c1[2]))
+	cv.t3 = float64(int8(c1[3]))
+	cv.p1 = float64(bosch.Uint16LE(c1[5], c1[6]))
+	cv.p2 = float64(bosch.Int16LE(c1[7], c1[8]))
+	cv.p3 = float64(int8(c1[9]))
+	cv.p4 = float64(bosch.Int16LE(c1[11], c1[12]))
+	cv.p5 = float64(bosch.Int16LE(c1[13], c1[14]))
+	cv.p7 = float64(int8(c1[15]))
+	cv.p6 = float64(int8(c1[16]))
+	cv.p8 = float64(bosch.Int16LE(c1[19], c1[20]))
+	cv.p9 = float64(bosch.Int16LE(c1[21], c1[22]))
+	cv.p10 = float64(c1[23])
+
+	cv.h2 = float64(uint16(c2[0])<<4 | uint16(c2[1]>>4))
+	cv.h1 = float64(uint16(c2[2])<<4 | uint16(c2[1]&0x0F))
+	cv.h3 = float64(int8(c2[3]))
+	cv.h4 = float64(int8(c2[4]))
+	cv.h5 = float64(int8(c2[5]))
+	cv.h6 = float64(c2[6])
+	cv.h7 = float64(int8(c2[7]))
+	cv.t1 = float64(bosch.Uint16LE(c2[8], c2[9]))
+	cv.gh2 = float64(bosch.Int16LE(c2[10], c2[11]))
+	cv.gh1 = float64(int8(c2[12]))
+	cv.gh3 = float64(int8(c2[13]))
+
+	read, err := dev.ReadRegisters(REG_RES_HEAT_VAL, 5)
+	if err != nil {
+		return cv, err
+	}
+	cv.resHeatVal = float64(int8(read[REG_RES_HEAT_VAL]))
+	cv.resHeatRange = float64((read[REG_RES_HEAT_RNG] & 0x30) >> 4)
+	cv.rangeSwitchError = float64(int8(read[REG_RANGE_SW_ERR]&0xF0) / 16)
+
+	return cv, nil
+}
+
+func (d *BME680) SetConfiguration(c bme280.Configuration) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if c == d.config {
+		return nil
+	}
+	log.Printf("Bme680: Set configuration %+v", c)
+	if c.Mode != bme280.MODE_FORCED {
+		log.Printf("Bme680: Mode %s not supported, using forced mode", c.Mode)
+	}
+	if err := d.dev.WriteRegister(REG_CTRL_HUM, bosch.OversamplingBits[c.OversamplingHumidity]); err != nil {
+		return err
+	}
+	if err := d.dev.WriteRegister(REG_CONFIG, bosch.FilterBits[c.Filter]<<2); err != nil {
+		return err
+	}
+	if err := d.dev.WriteRegister(REG_GAS_WAIT_0, gasWait(heaterTime)); err != nil {
+		return err
+	}
+	if err := d.dev.WriteRegister(REG_RES_HEAT_0, heaterResistance(d.cv, heaterTemp, 25)); err != nil {
+		return err
+	}
+	if err := d.dev.WriteRegister(REG_CTRL_GAS_1, RUN_GAS); err != nil {
+		return err
+	}
+	d.config = c
+	return nil
+}
+
+func (d *BME680) ctrlMeas(mode byte) byte {
+	return bosch.OversamplingBits[d.config.OversamplingTemperature]<<5 | bosch.OversamplingBits[d.config.OversamplingPressure]<<2 | mode
+}
+
+func (d *BME680) ReadValues() (bme280.Result, error) {
+	reading, err := d.ReadReading()
+	return reading.Result, err
+}
+
+// Read compensated values together with raw ADC values and t_fine
+func (d *BME680) ReadReading() (bme280.Reading, error) {
+	log.Println("Bme680: Read values")
+	if err := d.dev.WriteRegister(REG_CTRL_MEAS, d.ctrlMeas(MODE_FORCED)); err != nil {
+		return bme280.Reading{}, err
+	}
+	time.Sleep(heaterTime * time.Millisecond)
+
+	deadline := time.Now().Add(measurementTimeout)
+	var read []byte
+	var err error
+	for {
+		read, err = d.dev.ReadRegisters(REG_MEAS_STATUS, dataSize)
+		if err != nil {
+			return bme280.Reading{}, err
+		}
+		if read[0]&STATUS_NEW_DATA != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return bme280.Reading{}, &bme280.TimeoutError{Operation: "measurement", Timeout: measurementTimeout}
+		}
+		time.Sleep(statusPollInterval)
+	}
+
+	reading := bme280.Reading{Time: time.Now()}
+	reading.RawPressure = int32(uint32(read[2])<<12 | uint32(read[3])<<4 | uint32(read[4])>>4)
+	reading.RawTemperature = int32(uint32(read[5])<<12 | uint32(read[6])<<4 | uint32(read[7])>>4)
+	reading.RawHumidity = int32(uint32(read[8])<<8 | uint32(read[9]))
+	reading.RawGasResistance = int32(uint32(read[13])<<2 | uint32(read[14])>>6)
+	reading.GasRange = read[14] & 0x0F
+
+	tFine, temp := temperature(d.cv, float64(reading.RawTemperature))
+	humidity := humidity(d.cv, float64(reading.RawHumidity), temp)
+	reading.TFine = int32(tFine)
+	reading.Result = bme280.Result{
+		Temperature: float32(temp),
+		Pressure:    float32(pressure(d.cv, float64(reading.RawPressure), tFine) / 100.0),
+		Humidity:    float32(humidity),
+		Channels:    bme280.CHANNEL_HUMIDITY,
+	}
+	if read[14]&GAS_VALID != 0 && read[14]&HEAT_STABLE != 0 {
+		reading.GasResistance = float32(gasResistance(d.cv, float64(reading.RawGasResistance), reading.GasRange))
+		reading.Channels |= bme280.CHANNEL_GAS
+	} else {
+		log.Println("Bme680: Gas measurement not valid")
+	}
+	if humidity <= 0.0 || humidity >= 100.0 {
+		return reading, &bme280.InvalidValueError{Channel: "humidity", Value: reading.Humidity, Reason: "compensation out of range"}
+	}
+	reading.Result, err = bme280.SanityCheck(reading.Result)
+	return reading, err
+}
+
+// Floating point compensation formulas from the datasheet (chapter 3.3)
+func temperature(cv CompensationValues, raw float64) (tFine float64, temp float64) {
+	var1 := (raw/16384.0 - cv.t1/1024.0) * cv.t2
+	var2 := (raw/131072.0 - cv.t1/8192.0) * (raw/131072.0 - cv.t1/8192.0) * (cv.t3 * 16.0)
+	tFine = var1 + var2
+	return tFine, tFine / 5120.0
+}
+
+// Pressure in Pa
+func pressure(cv CompensationValues, raw float64, tFine float64) float64 {
+	var1 := tFine/2.0 - 64000.0
+	var2 := var1 * var1 * (cv.p6 / 131072.0)
+	var2 = var2 + var1*cv.p5*2.0
+	var2 = var2/4.0 + cv.p4*65536.0
+	var1 = (cv.p3*var1*var1/16384.0 + cv.p2*var1) / 524288.0
+	var1 = (1.0 + var1/32768.0) * cv.p1
+	if int(var1) == 0 {
+		return 0 // avoid exception caused by division by zero
+	}
+	p := 1048576.0 - raw
+	p = (p - var2/4096.0) * 6250.0 / var1
+	var1 = cv.p9 * p * p / 2147483648.0
+	var2 = p * (cv.p8 / 32768.0)
+	var3 := (p / 256.0) * (p / 256.0) * (p / 256.0) * (cv.p10 / 131072.0)
+	return p + (var1+var2+var3+cv.p7*128.0)/16.0
+}
+
+func humidity(cv CompensationValues, raw float64, temp float64) float64 {
+	var1 := raw - (cv.h1*16.0 + (cv.h3/2.0)*temp)
+	var2 := var1 * (cv.h2 / 262144.0 * (1.0 + (cv.h4/16384.0)*temp + (cv.h5/1048576.0)*temp*temp))
+	var3 := cv.h6 / 16384.0
+	var4 := cv.h7 / 2097152.0
+	h := var2 + (var3+var4*temp)*var2*var2
+	return math.Max(0.0, math.Min(100.0, h))
+}
+
+var lookupK1Range = [16]float64{0.0, 0.0, 0.0, 0.0, 0.0, -1.0, 0.0, -0.8, 0.0, 0.0, -0.2, -0.5, 0.0, -1.0, 0.0, 0.0}
+var lookupK2Range = [16]float64{0.0, 0.0, 0.0, 0.0, 0.1, 0.7, 0.0, -0.8, -0.1, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0}
+
+// Gas resistance in ohm
+func gasResistance(cv CompensationValues, raw float64, gasRange byte) float64 {
+	var1 := 1340.0 + 5.0*cv.rangeSwitchError
+	var2 := var1 * (1.0 + lookupK1Range[gasRange]/100.0)
+	var3 := 1.0 + lookupK2Range[gasRange]/100.0
+	return 1.0 / (var3 * 0.000000125 * float64(uint32(1)<<gasRange) * ((raw-512.0)/var2 + 1.0))
+}
+
+// Register value for the heater resistance at the target temperature
+func heaterResistance(cv CompensationValues, target float64, ambient float64) byte {
+	var1 := cv.gh1/16.0 + 49.0
+	var2 := (cv.gh2/32768.0)*0.0005 + 0.00235
+	var3 := cv.gh3 / 1024.0
+	var4 := var1 * (1.0 + var2*target)
+	var5 := var4 + var3*ambient
+	return byte(3.4 * (var5*(4.0/(4.0+cv.resHeatRange))*(1.0/(1.0+cv.resHeatVal*0.002)) - 25))
+}
+
+// Register value for the heating duration in ms
+func gasWait(ms int) byte {
+	if ms >= 0xFC0 {
+		return 0xFF
+	}
+	factor := 0
+	for ms > 0x3F {
+		ms = ms / 4
+		factor++
+	}
+	return byte(ms + factor*64)
+}
+
+// Initialise the chip connected via the transport; the transport
+// is closed when the initialisation fails.
+func InitBme680(d bme280.Transport) (*BME680, error) {
+	log.Print("Bme680: Init")
+
+	if err := devCheck(d); err != nil {
+		log.Println(err)
+		d.Close()
+		return nil, err
+	}
+	if err := reset(d); err != nil {
+		log.Println(err)
+		d.Close()
+		return nil, err
+	}
+
+	compensationValues, err := readCompensationValues(d)
+	if err != nil {
+		log.Println(err)
+		d.Close()
+		return nil, err
+	}
+
+	return &BME680{dev: d, cv: compensationValues}, nil
+}
+
+// Release the bus
+func (d *BME680) Close() error {
+	log.Print("Bme680: Close")
+	return d.dev.Close()
+}
@@ -0,0 +1,92 @@
+package calibration
+
+import (
+	"fmt"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+/**
+ * Correction of measured values against a reference instrument.
+ * Either offset and gain (corrected = measured * gain + offset) or
+ * two points with measured and reference values are given per channel.
+**/
+
+type Point struct {
+	Measured  float32 `yaml:"measured"`
+	Reference float32 `yaml:"reference"`
+}
+
+type Channel struct {
+	Offset float32 `yaml:"offset"`
+	// 0 is treated as 1
+	Gain float32 `yaml:"gain"`
+	// Two-point calibration; overrides offset and gain if set
+	Points []Point `yaml:"points"`
+}
+
+type Config struct {
+	Temperature Channel `yaml:"temperature"`
+	Pressure    Channel `yaml:"pressure"`
+	Humidity    Channel `yaml:"humidity"`
+}
+
+func (c Channel) Validate() error {
+	switch len(c.Points) {
+	case 0:
+	case 2:
+		if c.Points[0].Measured == c.Points[1].Measured {
+			return fmt.Errorf("calibration points need different measured values")
+		}
+	default:
+		return fmt.Errorf("two calibration points expected, got %d", len(c.Points))
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	if err := c.Temperature.Validate(); err != nil {
+		return fmt.Errorf("temperature: %v", err)
+	}
+	if err := c.Pressure.Validate(); err != nil {
+		return fmt.Errorf("pressure: %v", err)
+	}
+	if err := c.Humidity.Validate(); err != nil {
+		return fmt.Errorf("humidity: %v", err)
+	}
+	return nil
+}
+
+func (c Channel) gainAndOffset() (gain float32, offset float32) {
+	if len(c.Points) == 2 {
+		p0, p1 := c.Points[0], c.Points[1]
+		gain = (p1.Reference - p0.Reference) / (p1.Measured - p0.Measured)
+		offset = p0.Reference - gain*p0.Measured
+		return gain, offset
+	}
+	if c.Gain == 0 {
+		return 1, c.Offset
+	}
+	return c.Gain, c.Offset
+}
+
+func (c Channel) Apply(v float32) float32 {
+	gain, offset := c.gainAndOffset()
+	return v*gain + offset
+}
+
+// Corrected values for a raw sensor reading; the gas resistance is not corrected.
+// A corrected humidity outside of 0..100 % is an InvalidValueError, as the
+// calibration does not fit the reading.
+func (c Config) Apply(raw bme280.Result) (bme280.Result, error) {
+	result := raw
+	result.Temperature = c.Temperature.Apply(raw.Temperature)
+	result.Pressure = c.Pressure.Apply(raw.Pressure)
+	if raw.HasHumidity() {
+		result.Humidity = c.Humidity.Apply(raw.Humidity)
+		if result.Humidity < 0 || result.Humidity > 100 {
+			return raw, &bme280.InvalidValueError{Channel: "humidity", Value: result.Humidity, Reason: "calibrated value out of range"}
+		}
+	}
+	return result, nil
+}
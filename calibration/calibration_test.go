@@ -0,0 +1,126 @@
+package calibration
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+func TestChannelApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		channel  Channel
+		value    float32
+		expected float32
+	}{
+		{"no calibration", Channel{}, 21.5, 21.5},
+		{"offset", Channel{Offset: -0.5}, 21.5, 21},
+		{"gain 0 is 1", Channel{Offset: 1, Gain: 0}, 20, 21},
+		{"offset and gain", Channel{Offset: 2, Gain: 1.1}, 50, 57},
+		{"two points", Channel{Points: []Point{{Measured: 10, Reference: 11}, {Measured: 30, Reference: 29}}}, 20, 20},
+		{"two points outside", Channel{Points: []Point{{Measured: 10, Reference: 11}, {Measured: 30, Reference: 29}}}, 40, 38},
+		{"points override offset and gain", Channel{Offset: 5, Gain: 2, Points: []Point{{Measured: 0, Reference: 1}, {Measured: 10, Reference: 11}}}, 5, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := test.channel.Apply(test.value); math.Abs(float64(v-test.expected)) > 1e-4 {
+				t.Errorf("%v, expected %v", v, test.expected)
+			}
+		})
+	}
+}
+
+func TestChannelValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     Channel
+		valid bool
+	}{
+		{"offset and gain", Channel{Offset: 1, Gain: 2}, true},
+		{"two points", Channel{Points: []Point{{10, 11}, {20, 21}}}, true},
+		{"one point", Channel{Points: []Point{{10, 11}}}, false},
+		{"three points", Channel{Points: []Point{{10, 11}, {20, 21}, {30, 31}}}, false},
+		{"same measured values", Channel{Points: []Point{{10, 11}, {10, 12}}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := (Config{Humidity: test.c}).Validate(); (err == nil) != test.valid {
+				t.Errorf("error %v, expected valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	config := Config{
+		Temperature: Channel{Offset: -1},
+		Pressure:    Channel{Gain: 1.01},
+		Humidity:    Channel{Offset: 5},
+	}
+	tests := []struct {
+		name     string
+		raw      bme280.Result
+		expected bme280.Result
+		// channel of the expected InvalidValueError
+		invalid string
+	}{
+		{
+			name:     "bme280",
+			raw:      bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 50, Channels: bme280.CHANNEL_HUMIDITY},
+			expected: bme280.Result{Temperature: 19, Pressure: 1010, Humidity: 55, Channels: bme280.CHANNEL_HUMIDITY},
+		},
+		{
+			name:     "humidity of 100 %",
+			raw:      bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 95, Channels: bme280.CHANNEL_HUMIDITY},
+			expected: bme280.Result{Temperature: 19, Pressure: 1010, Humidity: 100, Channels: bme280.CHANNEL_HUMIDITY},
+		},
+		{
+			name:    "humidity above 100 %",
+			raw:     bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 97, Channels: bme280.CHANNEL_HUMIDITY},
+			invalid: "humidity",
+		},
+		{
+			name:     "bmp280 without humidity",
+			raw:      bme280.Result{Temperature: 20, Pressure: 1000},
+			expected: bme280.Result{Temperature: 19, Pressure: 1010},
+		},
+		{
+			name:     "gas resistance is not corrected",
+			raw:      bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 50, GasResistance: 12345, Channels: bme280.CHANNEL_HUMIDITY | bme280.CHANNEL_GAS},
+			expected: bme280.Result{Temperature: 19, Pressure: 1010, Humidity: 55, GasResistance: 12345, Channels: bme280.CHANNEL_HUMIDITY | bme280.CHANNEL_GAS},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := config.Apply(test.raw)
+			if test.invalid != "" {
+				var invalidValue *bme280.InvalidValueError
+				if !errors.As(err, &invalidValue) || invalidValue.Channel != test.invalid {
+					t.Fatalf("error %v, expected an invalid %s", err, test.invalid)
+				}
+				if v != test.raw {
+					t.Errorf("%+v, expected the raw values", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Errorf("%+v, expected %+v", v, test.expected)
+			}
+		})
+	}
+}
+
+// A two-point calibration may move low readings below 0 %
+func TestConfigApplyHumidityBelowZero(t *testing.T) {
+	config := Config{Humidity: Channel{Points: []Point{{Measured: 20, Reference: 10}, {Measured: 80, Reference: 85}}}}
+	_, err := config.Apply(bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 5, Channels: bme280.CHANNEL_HUMIDITY})
+	var invalidValue *bme280.InvalidValueError
+	if !errors.As(err, &invalidValue) || invalidValue.Value >= 0 {
+		t.Errorf("error %v, expected a humidity below 0", err)
+	}
+}
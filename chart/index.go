@@ -9,34 +9,71 @@ import (
 	"github.com/tquellenberg/weatherstation/datastore"
 )
 
+var store *datastore.Store
+
+func SetStore(newStore *datastore.Store) {
+	store = newStore
+}
+
 type CurrentDataPage struct {
+	Sensor    string
+	Sensors   []string
+	TimeRange string
 }
 
 type CurrentDataJson struct {
-	CurrentTemperature float32 `json:"currentTemperature"`
-	CurrentPressure    float32 `json:"currentPressure"`
-	CurrentHumidity    float32 `json:"currentHumidity"`
-	PressureTrend      string  `json:"pressureTrend"`
+	CurrentTemperature   float32 `json:"currentTemperature"`
+	CurrentPressure      float32 `json:"currentPressure"`
+	CurrentHumidity      float32 `json:"currentHumidity"`
+	CurrentGasResistance float32 `json:"currentGasResistance"`
+	HasHumidity          bool    `json:"hasHumidity"`
+	HasGasResistance     bool    `json:"hasGasResistance"`
+	PressureTrend        string  `json:"pressureTrend"`
 }
 
 func CurrentValues(w http.ResponseWriter, req *http.Request) {
-	log.Print("Get current values")
-	values := datastore.GetLastValues()
+	sensor, ok := getSensor(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Printf("Get current values of sensor %s", sensor)
+	values := store.GetLastValues(sensor)
 	jsonData := CurrentDataJson{
-		CurrentTemperature: values[0].Value,
-		CurrentPressure:    values[1].Value,
-		CurrentHumidity:    values[2].Value,
-		PressureTrend:      datastore.GetPressureTrend(),
+		CurrentTemperature:   values[0].Value,
+		CurrentPressure:      values[1].Value,
+		CurrentHumidity:      values[2].Value,
+		CurrentGasResistance: values[3].Value,
+		HasHumidity:          !values[2].Time.IsZero(),
+		HasGasResistance:     !values[3].Time.IsZero(),
+		PressureTrend:        store.GetPressureTrend(sensor),
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(jsonData)
 }
 
+// Sensor selected by the request parameter "sensor"; the first sensor by default
+func getSensor(req *http.Request) (string, bool) {
+	sensor := req.URL.Query().Get("sensor")
+	if sensor == "" {
+		return store.GetSensorNames()[0], true
+	}
+	return sensor, store.IsSensorName(sensor)
+}
+
 func Index(w http.ResponseWriter, req *http.Request) {
+	sensor, ok := getSensor(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	tmpl := template.Must(template.ParseGlob("templates/*.html"))
-	err := tmpl.ExecuteTemplate(w, "index.html", CurrentDataPage{})
+	data := CurrentDataPage{
+		Sensor:  sensor,
+		Sensors: store.GetSensorNames()}
+	err := tmpl.ExecuteTemplate(w, "index.html", data)
 	if err != nil {
 		log.Print(err)
 	}
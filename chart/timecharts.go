@@ -2,9 +2,11 @@ package chart
 
 import (
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/tquellenberg/weatherstation/datastore"
@@ -12,6 +14,8 @@ import (
 )
 
 type PageData struct {
+	Sensor    string
+	Sensors   []string
 	TimeRange string
 	Xstart    string
 	Xend      string
@@ -24,73 +28,190 @@ type JsonDataEntry struct {
 	Value []interface{} `json:"value"`
 }
 
-type dataFunc func(start, end time.Time) ([]datastore.Entry, error)
+// Time zone of all times shown in charts and returned by the API
+var location = time.Local
+
+func SetLocation(newLocation *time.Location) {
+	location = newLocation
+}
+
+func formatTime(t time.Time) string {
+	return t.In(location).Format(datastore.DateTimeFormat)
+}
+
+// Channels by their name in requests
+var channels = map[string]datastore.CsvPos{
+	"temperature": datastore.TemperaturePos,
+	"pressure":    datastore.PressurePos,
+	"humidity":    datastore.HumidityPos,
+	"gas":         datastore.GasResistancePos,
+}
+
+// Channels of the time charts page
+var chartChannels = []string{"temperature", "pressure", "humidity", "gas"}
 
 type XRange int
 
 const (
 	Day XRange = iota
 	Week
+	Month
+	Year
 )
 
-func getTimeRange(req *http.Request) (start, end time.Time) {
-	var xRange XRange
+func getXRange(req *http.Request) XRange {
 	switch req.URL.Query().Get("range") {
 	case "week":
-		xRange = Week
-	default:
-		xRange = Day
+		return Week
+	case "month":
+		return Month
+	case "year":
+		return Year
 	}
+	return Day
+}
 
-	now := time.Now()
+func getTimeRange(xRange XRange) (start, end time.Time) {
+	now := time.Now().In(location)
 	year, month, day := now.Date()
-	xstart := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
-	if xRange == Week {
+	xstart := time.Date(year, month, day, 0, 0, 0, 0, location)
+	switch xRange {
+	case Week:
 		xstart = xstart.AddDate(0, 0, -6)
+	case Month:
+		xstart = xstart.AddDate(0, -1, 1)
+	case Year:
+		xstart = xstart.AddDate(-1, 0, 1)
 	}
-	xend := time.Date(year, month, day, 23, 59, 55, 0, now.Location())
+	xend := time.Date(year, month, day, 23, 59, 55, 0, location)
 	return xstart, xend
 }
 
+// Values are averaged per 5 minutes; month and year charts use the rollups
+func defaultBucket(xRange XRange) time.Duration {
+	switch xRange {
+	case Month:
+		return time.Hour
+	case Year:
+		return 24 * time.Hour
+	}
+	return 5 * time.Minute
+}
+
+// Query of the named channels for the parameters range, bucket (e.g. "15m")
+// and aggregation (avg, min, max, last or sum)
+func getSeriesQuery(req *http.Request, sensor string, names []string) (datastore.SeriesQuery, error) {
+	xRange := getXRange(req)
+	q := datastore.SeriesQuery{
+		Sensor:      sensor,
+		Bucket:      defaultBucket(xRange),
+		Aggregation: datastore.AGGREGATION_AVG,
+	}
+	q.Start, q.End = getTimeRange(xRange)
+	for _, name := range names {
+		pos, ok := channels[name]
+		if !ok {
+			return q, fmt.Errorf("unknown channel %q", name)
+		}
+		q.Channels = append(q.Channels, pos)
+	}
+	if bucket := req.URL.Query().Get("bucket"); bucket != "" {
+		d, err := time.ParseDuration(bucket)
+		if err != nil {
+			return q, err
+		}
+		q.Bucket = d
+	}
+	if aggregation := req.URL.Query().Get("aggregation"); aggregation != "" {
+		q.Aggregation = aggregation
+	}
+	return q, q.Validate()
+}
+
+func toJsonData(entries []datastore.Entry) []JsonDataEntry {
+	jsonData := make([]JsonDataEntry, 0, len(entries))
+	for _, v := range entries {
+		jsonData = append(jsonData, JsonDataEntry{Value: []interface{}{formatTime(v.Time), v.Value}})
+	}
+	return jsonData
+}
+
+// Series of all channels in the parameter channels (comma separated; all
+// channels of the charts by default) by channel name
+func SeriesData(w http.ResponseWriter, req *http.Request) {
+	names := chartChannels
+	if list := req.URL.Query().Get("channels"); list != "" {
+		names = strings.Split(list, ",")
+	}
+	writeSeries(w, req, names, func(series [][]datastore.Entry) interface{} {
+		result := make(map[string][]JsonDataEntry)
+		for i, name := range names {
+			result[name] = toJsonData(series[i])
+		}
+		return result
+	})
+}
+
 func TempData(w http.ResponseWriter, req *http.Request) {
-	jsonData(w, req, datastore.GetTemperatureSeries)
+	jsonData(w, req, "temperature")
 }
 
 func PressureData(w http.ResponseWriter, req *http.Request) {
-	jsonData(w, req, datastore.GetPressureSeries)
+	jsonData(w, req, "pressure")
 }
 
 func HumidityData(w http.ResponseWriter, req *http.Request) {
-	jsonData(w, req, datastore.GetHumiditySeries)
+	jsonData(w, req, "humidity")
+}
+
+func GasData(w http.ResponseWriter, req *http.Request) {
+	jsonData(w, req, "gas")
+}
+
+func jsonData(w http.ResponseWriter, req *http.Request, name string) {
+	writeSeries(w, req, []string{name}, func(series [][]datastore.Entry) interface{} {
+		return toJsonData(series[0])
+	})
 }
 
-func jsonData(w http.ResponseWriter, req *http.Request, dataFunc dataFunc) {
-	xstart, xend := getTimeRange(req)
-	tData, err := dataFunc(xstart, xend)
+func writeSeries(w http.ResponseWriter, req *http.Request, names []string, toJson func(series [][]datastore.Entry) interface{}) {
+	sensor, ok := getSensor(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q, err := getSeriesQuery(req, sensor, names)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := store.QuerySeries(q)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else {
-		jsonData := make([]JsonDataEntry, 0, len(tData))
-		for _, v := range tData {
-			jsonData = append(jsonData, JsonDataEntry{Value: []interface{}{v.Time, v.Value}})
-		}
-
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(jsonData)
+		json.NewEncoder(w).Encode(toJson(series))
 	}
 }
 
 func TimeCharts(w http.ResponseWriter, req *http.Request) {
-	xstart, xend := getTimeRange(req)
+	sensor, ok := getSensor(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	xstart, xend := getTimeRange(getXRange(req))
 	sunrise, sunset := sun.GetDayInfo()
 	data := PageData{
+		Sensor:    sensor,
+		Sensors:   store.GetSensorNames(),
 		TimeRange: req.URL.Query().Get("range"),
-		Sunrise:   sunrise.Format(datastore.DateTimeFormat),
-		Sunset:    sunset.Format(datastore.DateTimeFormat),
-		Xstart:    xstart.Format(datastore.DateTimeFormat),
-		Xend:      xend.Format(datastore.DateTimeFormat)}
+		Sunrise:   formatTime(sunrise),
+		Sunset:    formatTime(sunset),
+		Xstart:    formatTime(xstart),
+		Xend:      formatTime(xend)}
 
 	tmpl := template.Must(template.ParseGlob("templates/*.html"))
 	err := tmpl.ExecuteTemplate(w, "timeCharts.html", data)
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+// Storage formats of the values
+const (
+	FORMAT_CSV    = "csv"
+	FORMAT_BINARY = "binary"
+	FORMAT_SQLITE = "sqlite"
+)
+
+// Values of one reading
+type record struct {
+	t time.Time
+	// Corrected values
+	res bme280.Result
+	// Uncorrected values; equal to res for values stored before calibration support
+	raw bme280.Result
+}
+
+// Value at a CSV position; false for channels which were not measured
+func (r record) value(pos CsvPos) (float32, bool) {
+	switch pos {
+	case TemperaturePos:
+		return r.res.Temperature, true
+	case PressurePos:
+		return r.res.Pressure, true
+	case HumidityPos:
+		return r.res.Humidity, r.res.HasHumidity()
+	case RawTemperaturePos:
+		return r.raw.Temperature, true
+	case RawPressurePos:
+		return r.raw.Pressure, true
+	case RawHumidityPos:
+		return r.raw.Humidity, r.raw.HasHumidity()
+	case GasResistancePos:
+		return r.res.GasResistance, r.res.HasGasResistance()
+	}
+	return 0, false
+}
+
+// Storage of the values of all sensors. Rollups and ADC values are
+// always stored as CSV. Callers of the writing methods hold fileLock.
+type backend interface {
+	// Append records which are ordered by time and newer than the stored ones
+	append(sensor string, records ...record) error
+	// Call fn for the records within [start, end) ordered by time;
+	// malformed records are skipped
+	scan(sensor string, start, end time.Time, fn func(r record) error) error
+	// Time of the first record; zero if there is none
+	first(sensor string) (time.Time, error)
+	// Up to n last records ordered by time
+	last(sensor string, n int) ([]record, error)
+	// Remove the records before cutoff
+	removeBefore(sensor string, cutoff time.Time) error
+	// Replace every record with the result of fn
+	rewrite(sensor string, fn func(r record) record) error
+	// Check and repair the stored values
+	fsck(sensor string, report *FsckReport) error
+}
+
+func newBackend(format string, l layout) (backend, error) {
+	switch format {
+	case FORMAT_CSV:
+		return csvBackend{l}, nil
+	case FORMAT_BINARY:
+		return binaryBackend{l}, nil
+	case FORMAT_SQLITE:
+		return openSqlite(l)
+	}
+	return nil, fmt.Errorf("unknown storage format %q", format)
+}
+
+// Time after all stored values
+var endOfTime = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const convertBatchSize = 1000
+
+// Copy the values of all sensors into the given format. The copy must be
+// empty; the source is kept until the format is switched in the configuration.
+func (s *Store) ConvertTo(format string) error {
+	target, err := newBackend(format, s.layout)
+	if err != nil {
+		return err
+	}
+	if closer, ok := target.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	for _, sensor := range s.sensorNames {
+		if first, err := target.first(sensor); err != nil {
+			return err
+		} else if !first.IsZero() {
+			return fmt.Errorf("sensor %s already has values in format %s", sensor, format)
+		}
+		count := 0
+		batch := make([]record, 0, convertBatchSize)
+		err := s.backend.scan(sensor, time.Time{}, endOfTime, func(r record) error {
+			batch = append(batch, r)
+			count++
+			if len(batch) < convertBatchSize {
+				return nil
+			}
+			err := target.append(sensor, batch...)
+			batch = batch[:0]
+			return err
+		})
+		if err == nil && len(batch) > 0 {
+			err = target.append(sensor, batch...)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Converted %d values of sensor %s to %s", count, sensor, format)
+	}
+	log.Printf("Set storage format to %s in weatherstation.yml to use the converted values", format)
+	return nil
+}
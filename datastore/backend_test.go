@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Size of all files below dir
+func diskSize(tb testing.TB, dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return size
+}
+
+// Query of a day and of a month from a year of values; disk-bytes is the
+// size of the stored values
+func BenchmarkBackends(b *testing.B) {
+	ranges := []struct {
+		name  string
+		start time.Time
+	}{
+		{"day", benchEnd.AddDate(0, 0, -1)},
+		{"month", benchEnd.AddDate(0, -1, 0)},
+	}
+	for _, format := range []string{FORMAT_CSV, FORMAT_BINARY} {
+		for _, r := range ranges {
+			b.Run(format+"/"+r.name, func(b *testing.B) {
+				s := benchStore(b, format, 12)
+				q := SeriesQuery{
+					Sensor:      DefaultSensor,
+					Channels:    []CsvPos{TemperaturePos, PressurePos, HumidityPos},
+					Start:       r.start,
+					End:         benchEnd,
+					Aggregation: AGGREGATION_AVG,
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.QuerySeries(q); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(diskSize(b, s.dir)), "disk-bytes")
+			})
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+/**
+ * Binary values are stored in one file per UTC day:
+ *   <dir>/<sensor>/2021-08-28.bin
+ * A file starts with a header of 12 bytes: the magic "WSB1" and the start of
+ * the day in seconds since 1970 (int64). It is followed by records of 32
+ * bytes: the seconds since the start of the day (uint32) and the float32
+ * values temperature, pressure, humidity, raw temperature, raw pressure,
+ * raw humidity and gas resistance. Channels which were not measured are NaN.
+ * All numbers are little endian. The records of a file are ordered by time,
+ * so a time is found by binary search.
+**/
+
+const (
+	binSuffix       = ".bin"
+	binMagic        = "WSB1"
+	binHeaderLength = 12
+	binRecordLength = 32
+)
+
+var errBadHeader = errors.New("bad header")
+
+// Values in fixed size records
+type binaryBackend struct {
+	layout
+}
+
+func (b binaryBackend) filename(sensor string, t time.Time) string {
+	return b.sensorDir(sensor) + "/" + t.UTC().Format(dayFormat) + binSuffix
+}
+
+// Binary files of the sensor which overlap [start, end), sorted by time
+func (b binaryBackend) files(sensor string, start, end time.Time) ([]dataFile, error) {
+	// without a stat of every file, as there is one per day
+	entries, err := os.ReadDir(b.sensorDir(sensor))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]dataFile, 0)
+	for _, info := range entries {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), binSuffix) {
+			continue
+		}
+		fileStart, err := time.Parse(dayFormat, strings.TrimSuffix(info.Name(), binSuffix))
+		if err != nil {
+			continue
+		}
+		fileEnd := fileStart.AddDate(0, 0, 1)
+		if !fileEnd.After(start) || !fileStart.Before(end) {
+			continue
+		}
+		files = append(files, dataFile{name: b.sensorDir(sensor) + "/" + info.Name(), start: fileStart, end: fileEnd})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].start.Before(files[j].start)
+	})
+	return files, nil
+}
+
+func encodeHeader(day time.Time) []byte {
+	buf := make([]byte, binHeaderLength)
+	copy(buf, binMagic)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(day.Unix()))
+	return buf
+}
+
+func decodeHeader(buf []byte) (time.Time, error) {
+	if len(buf) < binHeaderLength || string(buf[:4]) != binMagic {
+		return time.Time{}, errBadHeader
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint64(buf[4:])), 0).UTC(), nil
+}
+
+// Values of channels which were not measured are NaN
+func encodeRecord(buf []byte, day time.Time, r record) {
+	nan := float32(math.NaN())
+	humidity, rawHumidity, gas := nan, nan, nan
+	if r.res.HasHumidity() {
+		humidity, rawHumidity = r.res.Humidity, r.raw.Humidity
+	}
+	if r.res.HasGasResistance() {
+		gas = r.res.GasResistance
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(r.t.Unix()-day.Unix()))
+	values := []float32{r.res.Temperature, r.res.Pressure, humidity,
+		r.raw.Temperature, r.raw.Pressure, rawHumidity, gas}
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[4+4*i:], math.Float32bits(v))
+	}
+}
+
+func decodeRecord(buf []byte, day time.Time) record {
+	var values [7]float32
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4+4*i:]))
+	}
+	r := record{t: day.Add(time.Duration(binary.LittleEndian.Uint32(buf)) * time.Second)}
+	r.res = bme280.Result{Temperature: values[0], Pressure: values[1]}
+	r.raw = bme280.Result{Temperature: values[3], Pressure: values[4]}
+	if !math.IsNaN(float64(values[2])) {
+		r.res.Humidity, r.raw.Humidity = values[2], values[5]
+		r.res.Channels |= bme280.CHANNEL_HUMIDITY
+		r.raw.Channels |= bme280.CHANNEL_HUMIDITY
+	}
+	if !math.IsNaN(float64(values[6])) {
+		r.res.GasResistance, r.raw.GasResistance = values[6], values[6]
+		r.res.Channels |= bme280.CHANNEL_GAS
+		r.raw.Channels |= bme280.CHANNEL_GAS
+	}
+	return r
+}
+
+// Start of the day and number of complete records of an open file
+func readHeader(f *os.File) (time.Time, int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	buf := make([]byte, binHeaderLength)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		return time.Time{}, 0, errBadHeader
+	}
+	day, err := decodeHeader(buf)
+	return day, int((info.Size() - binHeaderLength) / binRecordLength), err
+}
+
+// All records of a file; a partial record at the end is ignored
+func readRecords(filename string) ([]record, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	day, err := decodeHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	n := (len(data) - binHeaderLength) / binRecordLength
+	records := make([]record, n)
+	for i := range records {
+		records[i] = decodeRecord(data[binHeaderLength+i*binRecordLength:], day)
+	}
+	return records, nil
+}
+
+func encodeRecords(day time.Time, records []record) []byte {
+	buf := make([]byte, binHeaderLength+len(records)*binRecordLength)
+	copy(buf, encodeHeader(day))
+	for i, r := range records {
+		encodeRecord(buf[binHeaderLength+i*binRecordLength:], day, r)
+	}
+	return buf
+}
+
+func (b binaryBackend) append(sensor string, records ...record) error {
+	for i := 0; i < len(records); {
+		filename := b.filename(sensor, records[i].t)
+		day := records[i].t.UTC().Truncate(24 * time.Hour)
+		j := i
+		for ; j < len(records) && b.filename(sensor, records[j].t) == filename; j++ {
+		}
+		if err := appendRecords(filename, day, records[i:j]); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// Append records and sync them to disk. A partial record at the end, left
+// by a power cut during a write, is overwritten.
+func appendRecords(filename string, day time.Time, records []record) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	var buf []byte
+	if size < binHeaderLength {
+		buf = encodeRecords(day, records)
+		size = 0
+	} else {
+		buf = encodeRecords(day, records)[binHeaderLength:]
+		size -= (size - binHeaderLength) % binRecordLength
+	}
+	if _, err = f.WriteAt(buf, size); err != nil {
+		return err
+	}
+	if err = f.Truncate(size + int64(len(buf))); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// make a new file durable
+		return syncDir(dir)
+	}
+	return nil
+}
+
+func (b binaryBackend) scan(sensor string, start, end time.Time, fn func(r record) error) error {
+	files, err := b.files(sensor, start, end)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = scanRecords(file.name, start, end, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanRecords(filename string, start, end time.Time, fn func(r record) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	day, n, err := readHeader(f)
+	if err != nil {
+		log.Printf("Skipped %s: %v; use -fsck to repair", filename, err)
+		return nil
+	}
+
+	buf := make([]byte, binRecordLength)
+	recordAt := func(i int) (record, error) {
+		if _, err := f.ReadAt(buf, binHeaderLength+int64(i)*binRecordLength); err != nil {
+			return record{}, err
+		}
+		return decodeRecord(buf, day), nil
+	}
+	var searchErr error
+	i := sort.Search(n, func(i int) bool {
+		r, err := recordAt(i)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return !r.t.Before(start)
+	})
+	if searchErr != nil {
+		return searchErr
+	}
+
+	offset := binHeaderLength + int64(i)*binRecordLength
+	r := bufio.NewReader(io.NewSectionReader(f, offset, int64(n-i)*binRecordLength))
+	for ; i < n; i++ {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		rec := decodeRecord(buf, day)
+		if !rec.t.Before(end) {
+			return nil
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b binaryBackend) first(sensor string) (time.Time, error) {
+	files, err := b.files(sensor, time.Time{}, endOfTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, file := range files {
+		var t time.Time
+		err = scanRecords(file.name, time.Time{}, endOfTime, func(r record) error {
+			t = r.t
+			return io.EOF
+		})
+		if err != nil && err != io.EOF {
+			return time.Time{}, err
+		}
+		if !t.IsZero() {
+			return t, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+func (b binaryBackend) last(sensor string, n int) ([]record, error) {
+	files, err := b.files(sensor, time.Time{}, endOfTime)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]record, 0, n)
+	for i := len(files) - 1; i >= 0 && len(records) < n; i-- {
+		fileRecords, err := readRecords(files[i].name)
+		if err != nil {
+			log.Printf("Skipped %v; use -fsck to repair", err)
+			continue
+		}
+		if len(fileRecords) > n-len(records) {
+			fileRecords = fileRecords[len(fileRecords)-(n-len(records)):]
+		}
+		records = append(fileRecords, records...)
+	}
+	return records, nil
+}
+
+func (b binaryBackend) removeBefore(sensor string, cutoff time.Time) error {
+	files, err := b.files(sensor, time.Time{}, cutoff)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.end.After(cutoff) {
+			log.Printf("Retention: removing %s", file.name)
+			if err = os.Remove(file.name); err != nil {
+				return err
+			}
+			continue
+		}
+		records, err := readRecords(file.name)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(records), func(i int) bool { return !records[i].t.Before(cutoff) })
+		if i == 0 {
+			continue
+		}
+		if err = replaceFile(file.name, string(encodeRecords(file.start, records[i:]))); err != nil {
+			return err
+		}
+		log.Printf("Retention: removed %d records from %s", i, file.name)
+	}
+	return nil
+}
+
+func (b binaryBackend) rewrite(sensor string, fn func(r record) record) error {
+	files, err := b.files(sensor, time.Time{}, endOfTime)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		records, err := readRecords(file.name)
+		if err != nil {
+			return fmt.Errorf("%v; use -fsck to repair", err)
+		}
+		for i, r := range records {
+			records[i] = fn(r)
+		}
+		if err = replaceFile(file.name, string(encodeRecords(file.start, records))); err != nil {
+			return err
+		}
+		log.Printf("Rewrote %d entries of %s", len(records), file.name)
+	}
+	return nil
+}
+
+// Files with a bad header are moved to <file>.malformed, partial records
+// at the end are removed and records are sorted by time
+func (b binaryBackend) fsck(sensor string, report *FsckReport) error {
+	files, err := b.files(sensor, time.Time{}, endOfTime)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		report.Files++
+		data, err := ioutil.ReadFile(file.name)
+		if err != nil {
+			return err
+		}
+		day, err := decodeHeader(data)
+		if err == nil && !day.Equal(file.start) {
+			err = fmt.Errorf("header of %s", day.Format(dayFormat))
+		}
+		if err != nil {
+			log.Printf("%s: %v", file.name, err)
+			report.Malformed++
+			if err = os.Rename(file.name, file.name+".malformed"); err != nil {
+				return err
+			}
+			continue
+		}
+		records, err := readRecords(file.name)
+		if err != nil {
+			return err
+		}
+		report.Lines += len(records)
+		repair := false
+		if partial := (len(data) - binHeaderLength) % binRecordLength; partial > 0 {
+			log.Printf("%s: partial record of %d bytes", file.name, partial)
+			report.Malformed++
+			repair = true
+		}
+		byTime := func(i, j int) bool { return records[i].t.Before(records[j].t) }
+		if !sort.SliceIsSorted(records, byTime) {
+			log.Printf("%s: records are not ordered by time", file.name)
+			sort.SliceStable(records, byTime)
+			report.Unordered++
+			repair = true
+		}
+		if !repair {
+			continue
+		}
+		if err = replaceFile(file.name, string(encodeRecords(day, records))); err != nil {
+			return err
+		}
+		report.Repaired++
+		log.Printf("%s: repaired", file.name)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+// Values as CSV text in rotated files
+type csvBackend struct {
+	layout
+}
+
+func (b csvBackend) append(sensor string, records ...record) error {
+	for i := 0; i < len(records); {
+		filename := b.getFilename(sensor, records[i].t)
+		columns := make([][]string, 0, len(records)-i)
+		for ; i < len(records) && b.getFilename(sensor, records[i].t) == filename; i++ {
+			columns = append(columns, toColumns(records[i]))
+		}
+		if err := appendLines(filename, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b csvBackend) scan(sensor string, start, end time.Time, fn func(r record) error) error {
+	files, err := b.dataFiles(sensor, start, end)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = scanDataFile(file.name, start, end, func(t time.Time, line []string) error {
+			r, err := recordFromColumns(t, line)
+			if err != nil {
+				return errMalformedLine
+			}
+			return fn(r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b csvBackend) first(sensor string) (time.Time, error) {
+	files, err := b.allDataFiles(sensor)
+	if err != nil || len(files) == 0 {
+		return time.Time{}, err
+	}
+	return firstTime(files[0].name)
+}
+
+func (b csvBackend) last(sensor string, n int) ([]record, error) {
+	files, err := b.allDataFiles(sensor)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, n)
+	for i := len(files) - 1; i >= 0 && len(lines) < n; i-- {
+		tail, err := tailLines(files[i].name, n-len(lines))
+		if err != nil {
+			return nil, err
+		}
+		lines = append(tail, lines...)
+	}
+
+	records := make([]record, 0, len(lines))
+	for _, l := range lines {
+		// an incomplete last line is skipped
+		line, err := csv.NewReader(strings.NewReader(l)).Read()
+		if err != nil {
+			continue
+		}
+		t, err := parseTimestamp(line[DatePos])
+		if err != nil {
+			continue
+		}
+		r, err := recordFromColumns(t, line)
+		if err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (b csvBackend) removeBefore(sensor string, cutoff time.Time) error {
+	files, err := b.dataFiles(sensor, time.Time{}, cutoff)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = rewriteFrom(file.name, cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b csvBackend) rewrite(sensor string, fn func(r record) record) error {
+	files, err := b.allDataFiles(sensor)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = rewriteFile(file.name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b csvBackend) fsck(sensor string, report *FsckReport) error {
+	files, err := b.allDataFiles(sensor)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = checkFile(file.name, validateValueLine, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Channels which were not measured are stored as empty columns
+func toColumns(r record) []string {
+	res, raw := r.res, r.raw
+	humidity, rawHumidity := "", ""
+	if res.HasHumidity() {
+		humidity = fmt.Sprintf("%3.2f", res.Humidity)
+		rawHumidity = fmt.Sprintf("%3.2f", raw.Humidity)
+	}
+	column := []string{formatTimestamp(r.t),
+		fmt.Sprintf("%3.2f", res.Temperature),
+		fmt.Sprintf("%4.2f", res.Pressure),
+		humidity,
+		fmt.Sprintf("%3.2f", raw.Temperature),
+		fmt.Sprintf("%4.2f", raw.Pressure),
+		rawHumidity}
+	if res.HasGasResistance() {
+		column = append(column, fmt.Sprintf("%.0f", res.GasResistance))
+	}
+	return column
+}
+
+func recordFromColumns(t time.Time, line []string) (record, error) {
+	res, err := valuesFromColumns(line, TemperaturePos)
+	if err != nil {
+		return record{}, err
+	}
+	raw, err := rawFromColumns(line)
+	if err != nil {
+		return record{}, err
+	}
+	return record{t: t, res: res, raw: raw}, nil
+}
+
+// Raw values of a stored line. Lines without raw values were written
+// before calibration support and contain uncorrected values.
+func rawFromColumns(line []string) (bme280.Result, error) {
+	first := TemperaturePos
+	if len(line) > int(RawHumidityPos) {
+		first = RawTemperaturePos
+	}
+	return valuesFromColumns(line, first)
+}
+
+// Temperature, pressure and humidity starting at column first and the gas resistance
+func valuesFromColumns(line []string, first CsvPos) (bme280.Result, error) {
+	if len(line) < int(first)+3 {
+		return bme280.Result{}, fmt.Errorf("%d columns instead of %d", len(line), int(first)+3)
+	}
+	var res bme280.Result
+	values := []*float32{&res.Temperature, &res.Pressure, &res.Humidity}
+	for i, value := range values {
+		column := line[int(first)+i]
+		if column == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(column, 32)
+		if err != nil {
+			return bme280.Result{}, err
+		}
+		*value = float32(v)
+	}
+	if line[int(first)+2] != "" {
+		res.Channels |= bme280.CHANNEL_HUMIDITY
+	}
+	if len(line) > int(GasResistancePos) && line[GasResistancePos] != "" {
+		v, err := strconv.ParseFloat(line[GasResistancePos], 32)
+		if err != nil {
+			return bme280.Result{}, err
+		}
+		res.GasResistance = float32(v)
+		res.Channels |= bme280.CHANNEL_GAS
+	}
+	return res, nil
+}
+
+// Replace every line of a file with the result of fn
+func rewriteFile(filename string, fn func(r record) record) error {
+	f, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v; use -fsck to repair", filename, err)
+	}
+
+	tmpFilename := filename + ".tmp"
+	out, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	for _, line := range lines {
+		t, err := parseTimestamp(line[DatePos])
+		var rec record
+		if err == nil {
+			rec, err = recordFromColumns(t, line)
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(tmpFilename)
+			return fmt.Errorf("%s: %v; use -fsck to repair", filename, err)
+		}
+		w.Write(toColumns(fn(rec)))
+	}
+	w.Flush()
+	if err = w.Error(); err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	log.Printf("Rewrote %d entries of %s", len(lines), filename)
+	return os.Rename(tmpFilename, filename)
+}
@@ -1,12 +1,13 @@
 package datastore
 
 import (
+	"bufio"
 	"container/list"
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"encoding/csv"
@@ -14,24 +15,25 @@ import (
 	"github.com/tquellenberg/weatherstation/bme280"
 )
 
+// Timestamps are stored in UTC
+const TimestampFormat = time.RFC3339
+
+// Local time without zone; written before timestamps were stored in UTC
 const DateTimeFormat = "2006-01-02 15:04:05"
 
-var dataDir string = "."
-var filename = "results.csv"
+// Name of the sensor of a station with a single sensor
+const DefaultSensor = "default"
 
 type Entry struct {
-	Time  string
+	Time  time.Time
 	Value float32
 }
 
-// Three entries with the last values for temp(0), pressure(1) and humidity(2)
-var lastValues []Entry
-
-// Last 30 pressure entries; used to determine the air pressure trend
-var pressureQueue = list.New()
-
 const pressureQueueMaxLength = 30
 
+// Period of the pressure trend; the queue holds a value per minute
+const pressureTrendWindow = pressureQueueMaxLength * time.Minute
+
 // Position in CSV file
 type CsvPos int
 
@@ -40,58 +42,82 @@ const (
 	TemperaturePos
 	PressurePos
 	HumidityPos
+	// Uncorrected sensor values; missing in lines written before calibration support
+	RawTemperaturePos
+	RawPressurePos
+	RawHumidityPos
+	// Only for sensors with gas measurement
+	GasResistancePos
 )
 
 func (pos CsvPos) String() string {
-	return []string{"date", "temperature", "pressure", "humidity"}[pos]
+	return []string{"date", "temperature", "pressure", "humidity",
+		"raw temperature", "raw pressure", "raw humidity", "gas resistance"}[pos]
 }
 
-func SetDataDir(newDataDir string) {
-	dataDir = newDataDir
-	dataDir = strings.TrimSuffix(dataDir, "/")
-	if dataDir != "" && dataDir != "." {
-		err := os.MkdirAll(dataDir, os.ModePerm)
-		if err != nil {
-			log.Println(err)
-		}
-	}
-	log.Printf("Data directory set to %s", dataDir)
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampFormat)
 }
 
-func getFilename() string {
-	return dataDir + "/" + filename
+// Parse a stored timestamp; lines of older versions have local time without zone
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(TimestampFormat, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(DateTimeFormat, s, time.Local)
 }
 
-func updateLastValue(res bme280.Result, t string) {
-	l := make([]Entry, 0, 3)
+func (s *Store) updateLastValue(sensor string, res bme280.Result, t time.Time) {
+	l := make([]Entry, 0, 4)
 	l = append(l, Entry{Time: t, Value: res.Temperature})
 	l = append(l, Entry{Time: t, Value: res.Pressure})
-	l = append(l, Entry{Time: t, Value: res.Humidity})
-	lastValues = l
+	if res.HasHumidity() {
+		l = append(l, Entry{Time: t, Value: res.Humidity})
+	} else {
+		l = append(l, Entry{})
+	}
+	if res.HasGasResistance() {
+		l = append(l, Entry{Time: t, Value: res.GasResistance})
+	} else {
+		l = append(l, Entry{})
+	}
+	s.lastValues[sensor] = l
 }
 
-func updatePressureQueue(res bme280.Result, t string) {
+func (s *Store) updatePressureQueue(sensor string, res bme280.Result, t time.Time) {
+	pressureQueue, ok := s.pressureQueues[sensor]
+	if !ok {
+		pressureQueue = list.New()
+		s.pressureQueues[sensor] = pressureQueue
+	}
 	pressureQueue.PushBack(Entry{Time: t, Value: res.Pressure})
 	for pressureQueue.Len() > pressureQueueMaxLength {
 		pressureQueue.Remove(pressureQueue.Front())
 	}
 }
 
-func GetLastValues() []Entry {
-	if len(lastValues) < 3 {
-		l := make([]Entry, 0, 3)
-		l = append(l, Entry{Time: "", Value: 0.0})
-		l = append(l, Entry{Time: "", Value: 0.0})
-		l = append(l, Entry{Time: "", Value: 0.0})
-		return l
+func (s *Store) GetLastValues(sensor string) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastValuesLocked(sensor)
+}
+
+func (s *Store) lastValuesLocked(sensor string) []Entry {
+	lastValues := s.lastValues[sensor]
+	if len(lastValues) < 4 {
+		return make([]Entry, 4)
 	}
-	return lastValues
+	// entries are replaced, never modified
+	return append([]Entry(nil), lastValues...)
 }
 
 // Return "up", "down" or ""
-func GetPressureTrend() string {
-	if pressureQueue.Len() > 0 {
-		currentPressure := GetLastValues()[1].Value
+func (s *Store) GetPressureTrend(sensor string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pressureQueue, ok := s.pressureQueues[sensor]
+	if ok && pressureQueue.Len() > 0 {
+		currentPressure := s.lastValuesLocked(sensor)[1].Value
 		pastPressure := pressureQueue.Front().Value.(Entry).Value
 		if currentPressure > pastPressure {
 			return "up"
@@ -102,84 +128,94 @@ func GetPressureTrend() string {
 	return ""
 }
 
-func AppendToStore(res bme280.Result) {
-	t := time.Now().Format(DateTimeFormat)
-	column := []string{t,
-		fmt.Sprintf("%3.2f", res.Temperature),
-		fmt.Sprintf("%4.2f", res.Pressure),
-		fmt.Sprintf("%3.2f", res.Humidity)}
+// Restore the last values and the pressure history of all sensors from the
+// end of the stored values
+func (s *Store) RestoreLastValues() {
+	for _, sensor := range s.sensorNames {
+		if err := s.restoreLastValues(sensor); err != nil {
+			log.Printf("Last values of sensor %s not restored: %v", sensor, err)
+		}
+	}
+}
 
-	updateLastValue(res, t)
-	updatePressureQueue(res, t)
-	f, err := os.OpenFile(getFilename(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+func (s *Store) restoreLastValues(sensor string) error {
+	records, err := s.backend.last(sensor, pressureQueueMaxLength)
 	if err != nil {
-		log.Println("Error: ", err)
-		return
+		return err
 	}
-	w := csv.NewWriter(f)
-	w.Write(column)
-	w.Flush()
-	f.Close()
-}
 
-func GetTemperatureSeries(start, end time.Time) ([]Entry, error) {
-	return getDataSeries(start, end, TemperaturePos)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// older values would show the change since before a downtime as trend
+	since := time.Now().Add(-pressureTrendWindow)
+	for _, r := range records {
+		s.updateLastValue(sensor, r.res, r.t)
+		if !r.t.Before(since) {
+			s.updatePressureQueue(sensor, r.res, r.t)
+		}
+	}
+	log.Printf("Restored %d values of sensor %s", len(records), sensor)
+	return nil
 }
 
-func GetPressureSeries(start, end time.Time) ([]Entry, error) {
-	return getDataSeries(start, end, PressurePos)
-}
+// Store corrected values together with the raw sensor values
+func (s *Store) AppendToStore(sensor string, res bme280.Result, raw bme280.Result) {
+	now := time.Now()
 
-func GetHumiditySeries(start, end time.Time) ([]Entry, error) {
-	return getDataSeries(start, end, HumidityPos)
-}
+	s.mu.Lock()
+	s.updateLastValue(sensor, res, now)
+	s.updatePressureQueue(sensor, res, now)
+	s.mu.Unlock()
 
-func getDataSeries(start, end time.Time, csvPos CsvPos) ([]Entry, error) {
-	log.Printf("Get %s series", csvPos)
-	result, err := getDataFromFile(start, end, csvPos)
-	if err != nil {
-		return nil, err
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if err := s.backend.append(sensor, record{t: now, res: res, raw: raw}); err != nil {
+		log.Println("Error: ", err)
+		return
 	}
-	log.Printf("Get %s series %d", csvPos, len(result))
-	return movingAvg(result, 5), nil
+	s.updateRollups(sensor, now)
 }
 
-func movingAvg(entries []Entry, minutes int) []Entry {
-	if len(entries) == 0 || minutes <= 1 {
-		return entries
-	}
-	now := time.Now()
-	start, _ := time.ParseInLocation(DateTimeFormat, entries[0].Time, now.Location())
-	startMinute := int(start.Minute()/minutes) * minutes
-	start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), startMinute, 0, 0, now.Location())
-	end := start.Add(time.Minute * time.Duration(minutes))
-	sumV := 0.0
-	counter := 0
-	result := make([]Entry, 0)
-	for _, e := range entries {
-		t, _ := time.ParseInLocation(DateTimeFormat, e.Time, now.Location())
-		if t.After(end) {
-			if counter > 0 {
-				// new avg value
-				v := avg(sumV, counter)
-				result = append(result, Entry{Time: end.Format(DateTimeFormat), Value: v})
-			}
-			// step forward
-			start = end
-			end = start.Add(time.Minute * time.Duration(minutes))
-			sumV = 0.0
-			counter = 0
+// Rewrite the store with corrected values calculated from the raw values
+func (s *Store) Recalibrate(sensor string, correct func(raw bme280.Result) (bme280.Result, error)) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	// values the calibration does not fit keep their former correction
+	kept := 0
+	err := s.backend.rewrite(sensor, func(r record) record {
+		if res, err := correct(r.raw); err == nil {
+			r.res = res
 		} else {
-			sumV = sumV + float64(e.Value)
-			counter = counter + 1
+			kept++
 		}
+		return r
+	})
+	if err != nil {
+		return err
 	}
-	if counter > 0 {
-		// last avg value
-		v := avg(sumV, counter)
-		result = append(result, Entry{Time: entries[len(entries)-1].Time, Value: v})
+	if kept > 0 {
+		log.Printf("Kept the former values of %d readings of sensor %s, as their calibrated values are invalid", kept, sensor)
+	}
+	log.Printf("Recalibrated values of sensor %s", sensor)
+	return s.rebuildRollups(sensor)
+}
+
+// Store raw ADC values and t_fine of a reading; the time is the measurement time
+func (s *Store) AppendAdcToStore(sensor string, reading bme280.Reading) {
+	column := []string{formatTimestamp(reading.Time),
+		strconv.Itoa(int(reading.RawTemperature)),
+		strconv.Itoa(int(reading.RawPressure)),
+		strconv.Itoa(int(reading.RawHumidity)),
+		strconv.Itoa(int(reading.TFine)),
+		strconv.Itoa(int(reading.RawGasResistance)),
+		strconv.Itoa(int(reading.GasRange))}
+
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if err := appendLine(s.getAdcFilename(sensor, reading.Time), column); err != nil {
+		log.Println("Error: ", err)
 	}
-	return result
 }
 
 func avg(sumV float64, counter int) float32 {
@@ -187,35 +223,68 @@ func avg(sumV float64, counter int) float32 {
 	return float32(int(v*100.0)) / 100.0
 }
 
-// Read time (first value) and value on position 'pos' from csv file
-func getDataFromFile(start, end time.Time, pos CsvPos) ([]Entry, error) {
-	f, err := os.OpenFile(getFilename(), os.O_RDONLY, 0644)
+// Returned by the callback of scanDataFile for lines which can not be used
+var errMalformedLine = errors.New("malformed line")
+
+// Call fn for every line of the file within [start, end). Malformed lines,
+// e.g. a line truncated by a power cut, are skipped and reported.
+func scanDataFile(filename string, start, end time.Time, fn func(t time.Time, line []string) error) error {
+	f, err := os.OpenFile(filename, os.O_RDONLY, 0644)
 	if err != nil {
-		log.Println("Error: ", err)
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
-	lines, err := csv.NewReader(f).ReadAll()
+	info, err := f.Stat()
 	if err != nil {
-		log.Println("Error: ", err)
-		return nil, err
+		return err
+	}
+	offset, err := seekTime(f, info.Size(), start)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
 	}
 
-	result := make([]Entry, 0, len(lines))
-	now := time.Now()
-	var v float64
-	for _, line := range lines {
-		t, _ := time.ParseInLocation(DateTimeFormat, line[DatePos], now.Location())
-		if t.Local().After(start) && t.Local().Before(end) {
-			e := Entry{}
-			e.Time = line[0]
-			if v, err = strconv.ParseFloat(line[pos], 32); err != nil {
-				return nil, err
-			}
-			e.Value = float32(v)
-			result = append(result, e)
+	r := csv.NewReader(bufio.NewReader(f))
+	// older lines have no raw values
+	r.FieldsPerRecord = -1
+	malformed := 0
+	defer func() {
+		if malformed > 0 {
+			log.Printf("Skipped %d malformed lines in %s; use -fsck to repair", malformed, filename)
+		}
+	}()
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			malformed++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t, err := parseTimestamp(line[DatePos])
+		if err != nil {
+			malformed++
+			continue
+		}
+		if !t.Before(end) {
+			return nil
+		}
+		if t.Before(start) {
+			continue
+		}
+		err = fn(t, line)
+		if err == errMalformedLine {
+			malformed++
+		} else if err != nil {
+			return err
 		}
 	}
-	return result, nil
 }
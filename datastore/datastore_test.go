@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Time
+	}{
+		{"utc", "2021-08-28T10:00:00Z", time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)},
+		{"offset", "2021-08-28T12:00:00+02:00", time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)},
+		{"legacy summer time", "2021-08-28 12:00:00", time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)},
+		{"legacy standard time", "2021-12-24 12:00:00", time.Date(2021, 12, 24, 11, 0, 0, 0, time.UTC)},
+		{"legacy before the change to standard time", "2021-10-31 01:59:00", time.Date(2021, 10, 30, 23, 59, 0, 0, time.UTC)},
+		// the hour from 2:00 to 3:00 is repeated; legacy lines are read as standard time
+		{"legacy in the repeated hour", "2021-10-31 02:30:00", time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC)},
+		{"legacy after the change to standard time", "2021-10-31 03:00:00", time.Date(2021, 10, 31, 2, 0, 0, 0, time.UTC)},
+		{"legacy before the change to summer time", "2021-03-28 01:59:00", time.Date(2021, 3, 28, 0, 59, 0, 0, time.UTC)},
+		{"legacy after the change to summer time", "2021-03-28 03:00:00", time.Date(2021, 3, 28, 1, 0, 0, 0, time.UTC)},
+		// 2:30 does not exist; it is read as one hour later
+		{"legacy in the skipped hour", "2021-03-28 02:30:00", time.Date(2021, 3, 28, 1, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := parseTimestamp(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Equal(test.expected) {
+				t.Errorf("%v, expected %v", v.UTC(), test.expected)
+			}
+		})
+	}
+	for _, value := range []string{"", "2021-08-28", "2021-08-28T10:00:00", "28.08.2021 10:00:00", "2021-08-28 25:00:00"} {
+		if _, err := parseTimestamp(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
+
+// Stored timestamps are UTC whatever the local time zone is
+func TestFormatTimestamp(t *testing.T) {
+	berlin := setLocal(t, "Europe/Berlin")
+	v := time.Date(2021, 10, 31, 2, 30, 0, 0, berlin)
+	for _, v := range []time.Time{v, v.Add(time.Hour)} {
+		s := formatTimestamp(v)
+		if s[len(s)-1] != 'Z' {
+			t.Errorf("%s is not UTC", s)
+		}
+		if parsed, err := parseTimestamp(s); err != nil || !parsed.Equal(v) {
+			t.Errorf("%s parsed as %v: %v", s, parsed, err)
+		}
+	}
+}
+
+// Rollup periods are hours and days in the time zone of the store
+func TestRollupPeriodsAcrossDST(t *testing.T) {
+	berlin := setLocal(t, "Europe/Berlin")
+	// 2:30 summer time and 2:30 standard time
+	first := time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	if h1, h2 := hourly.start(first, berlin), hourly.start(second, berlin); !h1.Equal(first.Add(-30*time.Minute)) || !h2.Equal(second.Add(-30*time.Minute)) {
+		t.Errorf("hours %v and %v", h1.UTC(), h2.UTC())
+	}
+	day := daily.start(first, berlin)
+	if !day.Equal(time.Date(2021, 10, 30, 22, 0, 0, 0, time.UTC)) || daily.next(day).Sub(day) != 25*time.Hour {
+		t.Errorf("day %v to %v", day.UTC(), daily.next(day).UTC())
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hours of a time zone with an offset of 5:30
+	if h := hourly.start(time.Date(2021, 8, 28, 10, 45, 0, 0, kolkata), kolkata); !h.Equal(time.Date(2021, 8, 28, 10, 0, 0, 0, kolkata)) {
+		t.Errorf("hour in Kolkata %v", h)
+	}
+	if day := daily.start(first, time.UTC); !day.Equal(time.Date(2021, 10, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("day in UTC %v", day)
+	}
+}
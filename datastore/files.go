@@ -0,0 +1,344 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Data files are rotated per day or per month. Every sensor has its own
+ * directory with files named by their period:
+ *   <dir>/<sensor>/2021-08.csv      (month)
+ *   <dir>/<sensor>/2021-08-28.csv   (day)
+ *   <dir>/<sensor>/adc-2021-08.csv  (raw ADC values)
+**/
+
+const (
+	ROTATION_DAY   = "day"
+	ROTATION_MONTH = "month"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+	csvSuffix   = ".csv"
+	adcPrefix   = "adc-"
+)
+
+// Names of the files below the data directory
+type layout struct {
+	dir      string
+	rotation string
+	// Time zone of periods; the time zone of the charts
+	location *time.Location
+}
+
+// One data file and the time period it covers
+type dataFile struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+func (l layout) sensorDir(sensor string) string {
+	return l.dir + "/" + sensor
+}
+
+func (l layout) periodName(t time.Time) string {
+	t = t.In(l.location)
+	if l.rotation == ROTATION_DAY {
+		return t.Format(dayFormat)
+	}
+	return t.Format(monthFormat)
+}
+
+func (l layout) getFilename(sensor string, t time.Time) string {
+	return l.sensorDir(sensor) + "/" + l.periodName(t) + csvSuffix
+}
+
+func (l layout) getAdcFilename(sensor string, t time.Time) string {
+	return l.sensorDir(sensor) + "/" + adcPrefix + l.periodName(t) + csvSuffix
+}
+
+// Period of a data file name; false for other files
+func (l layout) parsePeriod(name string) (start time.Time, end time.Time, ok bool) {
+	if !strings.HasSuffix(name, csvSuffix) {
+		return start, end, false
+	}
+	period := strings.TrimSuffix(name, csvSuffix)
+	if start, err := time.ParseInLocation(dayFormat, period, l.location); err == nil {
+		return start, start.AddDate(0, 0, 1), true
+	}
+	if start, err := time.ParseInLocation(monthFormat, period, l.location); err == nil {
+		return start, start.AddDate(0, 1, 0), true
+	}
+	return start, end, false
+}
+
+// Data files of the sensor which overlap [start, end], sorted by time
+func (l layout) dataFiles(sensor string, start, end time.Time) ([]dataFile, error) {
+	infos, err := ioutil.ReadDir(l.sensorDir(sensor))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]dataFile, 0)
+	for _, info := range infos {
+		fileStart, fileEnd, ok := l.parsePeriod(info.Name())
+		if !ok || info.IsDir() {
+			continue
+		}
+		// files written before a change of the time zone overlap their period by up to a day
+		if fileEnd.Before(start.AddDate(0, 0, -1)) || fileStart.After(end.AddDate(0, 0, 1)) {
+			continue
+		}
+		files = append(files, dataFile{name: l.sensorDir(sensor) + "/" + info.Name(), start: fileStart, end: fileEnd})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].start.Before(files[j].start)
+	})
+	return files, nil
+}
+
+// All data files of the sensor
+func (l layout) allDataFiles(sensor string) ([]dataFile, error) {
+	return l.dataFiles(sensor, time.Time{}, endOfTime)
+}
+
+// Callers hold fileLock
+func appendLine(filename string, column []string) error {
+	return appendLines(filename, [][]string{column})
+}
+
+// Append lines and sync them to disk. A last line without line break, left
+// by a power cut during a write, is terminated first so that only this line
+// is malformed. Callers hold fileLock.
+func appendLines(filename string, columns [][]string) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = f.Write([]byte{'\n'})
+		}
+	}
+	if err == nil {
+		w := csv.NewWriter(f)
+		if err = w.WriteAll(columns); err == nil {
+			err = w.Error()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && info.Size() == 0 {
+		// make a new file durable
+		err = syncDir(dir)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Files written before rotation support: results.csv for the default sensor,
+// results_<sensor>.csv for other sensors and adc[_<sensor>].csv
+func (l layout) legacyFilenames(sensor string) (results string, adc string) {
+	if sensor == DefaultSensor {
+		return l.dir + "/results.csv", l.dir + "/adc.csv"
+	}
+	return l.dir + "/results_" + sensor + ".csv", l.dir + "/adc_" + sensor + ".csv"
+}
+
+// Move the content of files written before rotation support into rotated
+// files or the configured storage format. The old files are renamed to
+// *.migrated afterwards.
+func (s *Store) MigrateLegacyFiles() {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	for _, sensor := range s.sensorNames {
+		results, adc := s.legacyFilenames(sensor)
+		var err error
+		if _, ok := s.backend.(csvBackend); ok {
+			err = migrateFile(results, func(t time.Time) string { return s.getFilename(sensor, t) })
+		} else {
+			err = s.migrateToBackend(results, sensor)
+		}
+		if err != nil {
+			log.Printf("Migration of %s failed: %v", results, err)
+		}
+		if err := migrateFile(adc, func(t time.Time) string { return s.getAdcFilename(sensor, t) }); err != nil {
+			log.Printf("Migration of %s failed: %v", adc, err)
+		}
+	}
+}
+
+// Append the values of a legacy file to the backend in batches
+func (s *Store) migrateToBackend(filename string, sensor string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrating %s", filename)
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	batch := make([]record, 0, convertBatchSize)
+	count, malformed := 0, 0
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			malformed++
+			continue
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		t, err := parseTimestamp(line[DatePos])
+		if err == nil {
+			err = validateValueLine(line)
+		}
+		var rec record
+		if err == nil {
+			rec, err = recordFromColumns(t, line)
+		}
+		if err != nil {
+			malformed++
+			continue
+		}
+		batch = append(batch, rec)
+		count++
+		if len(batch) == convertBatchSize {
+			if err = s.backend.append(sensor, batch...); err != nil {
+				f.Close()
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	f.Close()
+	if err = s.backend.append(sensor, batch...); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d values of sensor %s, skipped %d malformed lines", count, sensor, malformed)
+	return os.Rename(filename, filename+".migrated")
+}
+
+func migrateFile(filename string, target func(t time.Time) string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrating %s", filename)
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	writers := make(map[string]*csv.Writer)
+	files := make([]*os.File, 0)
+	closeAll := func() {
+		for _, w := range writers {
+			w.Flush()
+		}
+		for _, out := range files {
+			out.Close()
+		}
+		f.Close()
+	}
+	count, malformed := 0, 0
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			malformed++
+			continue
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+		t, err := parseTimestamp(line[DatePos])
+		if err != nil {
+			malformed++
+			continue
+		}
+		name := target(t)
+		w, ok := writers[name]
+		if !ok {
+			if err = os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+				closeAll()
+				return err
+			}
+			out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			files = append(files, out)
+			w = csv.NewWriter(out)
+			writers[name] = w
+		}
+		w.Write(line)
+		count++
+	}
+	for _, w := range writers {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			closeAll()
+			return err
+		}
+	}
+	for _, out := range files {
+		if err := out.Sync(); err != nil {
+			closeAll()
+			return err
+		}
+	}
+	closeAll()
+	log.Printf("Migrated %d lines into %d files, skipped %d malformed lines", count, len(writers), malformed)
+	return os.Rename(filename, filename+".migrated")
+}
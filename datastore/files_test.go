@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	// time zones without the zoneinfo of the system
+	_ "time/tzdata"
+)
+
+// Set the local time zone for a test; legacy lines are in local time
+func setLocal(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	time.Local = location
+	t.Cleanup(func() { time.Local = local })
+	return location
+}
+
+func TestFileNames(t *testing.T) {
+	berlin := setLocal(t, "Europe/Berlin")
+	// 00:30 in Berlin, still the previous day and month in UTC
+	v := time.Date(2021, 9, 1, 0, 30, 0, 0, berlin)
+	tests := []struct {
+		rotation string
+		location *time.Location
+		name     string
+		// length of the period
+		length time.Duration
+	}{
+		{ROTATION_MONTH, berlin, "2021-09", 30 * 24 * time.Hour},
+		{ROTATION_DAY, berlin, "2021-09-01", 24 * time.Hour},
+		{ROTATION_MONTH, time.UTC, "2021-08", 31 * 24 * time.Hour},
+		{ROTATION_DAY, time.UTC, "2021-08-31", 24 * time.Hour},
+	}
+	for _, test := range tests {
+		l := layout{dir: "data", rotation: test.rotation, location: test.location}
+		if name := l.getFilename(DefaultSensor, v); name != "data/default/"+test.name+".csv" {
+			t.Errorf("%s in %v: %s", test.rotation, test.location, name)
+		}
+		if name := l.getAdcFilename(DefaultSensor, v); name != "data/default/adc-"+test.name+".csv" {
+			t.Errorf("%s in %v: %s", test.rotation, test.location, name)
+		}
+		start, end, ok := l.parsePeriod(test.name + ".csv")
+		if !ok || start.After(v) || !end.After(v) || end.Sub(start) != test.length {
+			t.Errorf("%s in %v: period %v to %v", test.rotation, test.location, start, end)
+		}
+	}
+
+	l := layout{dir: "data", rotation: ROTATION_DAY, location: berlin}
+	// the day of the change to standard time has 25 hours
+	if start, end, _ := l.parsePeriod("2021-10-31.csv"); end.Sub(start) != 25*time.Hour {
+		t.Errorf("period of 2021-10-31 %v to %v", start, end)
+	}
+	for _, name := range []string{"daily.csv", "hourly-2021.csv", "adc-2021-08.csv", "2021-08.csv.malformed", "2021-8.csv"} {
+		if _, _, ok := l.parsePeriod(name); ok {
+			t.Errorf("%s is a data file", name)
+		}
+	}
+}
+
+func TestMigrateLegacyFiles(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	dir := t.TempDir()
+	// legacy lines are in local time, newer ones in UTC
+	results := lines(
+		"2021-08-31 23:59:00,20.00,1000.00,50.00",
+		"garbage",
+		"2021-09-01 00:01:00,21.00,1001.00,51.00",
+		"2021-09-01T00:02:00Z,22.00,1002.00,52.00,21.50,1001.50,51.50")
+	writeTestFile(t, filepath.Join(dir, "results.csv"), results)
+	writeTestFile(t, filepath.Join(dir, "adc.csv"), lines("2021-08-31 23:59:00,519888,415148,27136,128422,0,0"))
+	writeTestFile(t, filepath.Join(dir, "results_outdoor.csv"), lines("2021-08-30 12:00:00,15.00,1000.00,80.00"))
+
+	s, err := NewStore(dir, []string{DefaultSensor, "outdoor"}, ROTATION_MONTH, FORMAT_CSV, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MigrateLegacyFiles()
+
+	expected := map[string]string{
+		"default/2021-08.csv":     lines("2021-08-31 23:59:00,20.00,1000.00,50.00"),
+		"default/2021-09.csv":     lines("2021-09-01 00:01:00,21.00,1001.00,51.00", "2021-09-01T00:02:00Z,22.00,1002.00,52.00,21.50,1001.50,51.50"),
+		"default/adc-2021-08.csv": lines("2021-08-31 23:59:00,519888,415148,27136,128422,0,0"),
+		"outdoor/2021-08.csv":     lines("2021-08-30 12:00:00,15.00,1000.00,80.00"),
+		"results.csv.migrated":    results,
+		"results.csv":             "",
+		"adc.csv":                 "",
+		"results_outdoor.csv":     "",
+	}
+	for name, content := range expected {
+		if c := readTestFile(t, filepath.Join(dir, name)); c != content {
+			t.Errorf("%s: %q, expected %q", name, c, content)
+		}
+	}
+
+	// a second start finds nothing to migrate
+	s.MigrateLegacyFiles()
+	if c := readTestFile(t, filepath.Join(dir, "default/2021-09.csv")); c != expected["default/2021-09.csv"] {
+		t.Errorf("content after the second migration %q", c)
+	}
+	last := s.lastOf(t, DefaultSensor)
+	if !last.t.Equal(time.Date(2021, 9, 1, 0, 2, 0, 0, time.UTC)) || last.raw.Temperature != 21.5 {
+		t.Errorf("last record %+v", last)
+	}
+}
+
+func TestMigrateLegacyFilesToBinary(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "results.csv"), lines(
+		"2021-08-31 23:59:00,20.00,1000.00,50.00",
+		"2021-09-01 00:01:00,21.00,,51.00",
+		"2021-09-01T00:02:00Z,22.00,1002.00,52.00,21.50,1001.50,51.50"))
+	s, err := NewStore(dir, []string{DefaultSensor}, ROTATION_DAY, FORMAT_BINARY, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MigrateLegacyFiles()
+
+	var times []time.Time
+	err = s.backend.scan(DefaultSensor, time.Time{}, endOfTime, func(r record) error {
+		times = append(times, r.t)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the line without pressure is skipped
+	expected := []time.Time{time.Date(2021, 8, 31, 21, 59, 0, 0, time.UTC), time.Date(2021, 9, 1, 0, 2, 0, 0, time.UTC)}
+	if len(times) != len(expected) || !times[0].Equal(expected[0]) || !times[1].Equal(expected[1]) {
+		t.Errorf("migrated %v, expected %v", times, expected)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "results.csv.migrated")); err != nil {
+		t.Error(err)
+	}
+}
+
+// Last stored record of a sensor
+func (s *Store) lastOf(t *testing.T, sensor string) record {
+	t.Helper()
+	records, err := s.backend.last(sensor, 1)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("last record: %v, %v", records, err)
+	}
+	return records[0]
+}
@@ -0,0 +1,234 @@
+package datastore
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result of a check of all stored files
+type FsckReport struct {
+	Files int
+	Lines int
+	// Lines moved to <file>.malformed
+	Malformed int
+	// Files whose lines were not ordered by time
+	Unordered int
+	// Files which were rewritten
+	Repaired int
+}
+
+// Check all files of all sensors. Malformed lines are moved to
+// <file>.malformed and lines which are out of time order are sorted.
+// Values are checked by the backend of the storage format.
+func (s *Store) Fsck() (FsckReport, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	var report FsckReport
+	for _, sensor := range s.sensorNames {
+		files, err := filepath.Glob(s.sensorDir(sensor) + "/*" + csvSuffix)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			validate := s.fileValidator(filepath.Base(file))
+			if validate == nil || s.checkedByBackend(filepath.Base(file)) {
+				continue
+			}
+			if err = checkFile(file, validate, &report); err != nil {
+				return report, err
+			}
+		}
+		if err = s.backend.fsck(sensor, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Value files of the CSV backend
+func (s *Store) checkedByBackend(name string) bool {
+	_, isCsv := s.backend.(csvBackend)
+	_, _, isValueFile := s.parsePeriod(name)
+	return isCsv && isValueFile
+}
+
+// Validation of the lines of a file; nil for unknown files
+func (l layout) fileValidator(name string) func(line []string) error {
+	if strings.HasPrefix(name, adcPrefix) {
+		if _, _, ok := l.parsePeriod(strings.TrimPrefix(name, adcPrefix)); ok {
+			return validateAdcLine
+		}
+		return nil
+	}
+	if _, _, ok := l.parsePeriod(name); ok {
+		return validateValueLine
+	}
+	for _, p := range rollupPeriods {
+		if matched, _ := filepath.Match(filepath.Base(p.pattern("")), name); matched {
+			return validateRollupLine
+		}
+	}
+	return nil
+}
+
+// Date, temperature, pressure and humidity; raw values and gas resistance are optional
+func validateValueLine(line []string) error {
+	if len(line) < int(RawTemperaturePos) || len(line) > int(GasResistancePos)+1 {
+		return fmt.Errorf("%d columns", len(line))
+	}
+	if line[TemperaturePos] == "" || line[PressurePos] == "" {
+		return fmt.Errorf("temperature or pressure missing")
+	}
+	return validateFloats(line[1:])
+}
+
+// Date, raw temperature, pressure and humidity, t_fine, gas resistance and gas range
+func validateAdcLine(line []string) error {
+	if len(line) != 7 {
+		return fmt.Errorf("%d columns", len(line))
+	}
+	for _, column := range line[1:] {
+		if _, err := strconv.Atoi(column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRollupLine(line []string) error {
+	if len(line) != 1+len(rollupChannels)*columnsPerChannel {
+		return fmt.Errorf("%d columns", len(line))
+	}
+	return validateFloats(line[1:])
+}
+
+// Empty columns are valid
+func validateFloats(columns []string) error {
+	for _, column := range columns {
+		if column == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(column, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkFile(filename string, validate func(line []string) error, report *FsckReport) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	report.Files++
+	if len(data) == 0 {
+		return nil
+	}
+
+	type timedLine struct {
+		t    time.Time
+		text string
+	}
+	text := string(data)
+	valid := make([]timedLine, 0)
+	malformed := make([]string, 0)
+	// a missing line break at the end or empty lines are repaired as well
+	repair := !strings.HasSuffix(text, "\n")
+	for i, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if l == "" {
+			repair = true
+			continue
+		}
+		report.Lines++
+		line, err := csv.NewReader(strings.NewReader(l)).Read()
+		var t time.Time
+		if err == nil {
+			t, err = parseTimestamp(line[DatePos])
+		}
+		if err == nil {
+			err = validate(line)
+		}
+		if err != nil {
+			log.Printf("%s:%d: %v", filename, i+1, err)
+			malformed = append(malformed, l)
+			continue
+		}
+		valid = append(valid, timedLine{t: t, text: l})
+	}
+
+	byTime := func(i, j int) bool { return valid[i].t.Before(valid[j].t) }
+	if !sort.SliceIsSorted(valid, byTime) {
+		log.Printf("%s: lines are not ordered by time", filename)
+		sort.SliceStable(valid, byTime)
+		report.Unordered++
+		repair = true
+	}
+	if len(malformed) > 0 {
+		report.Malformed += len(malformed)
+		if err = appendToFile(filename+".malformed", strings.Join(malformed, "\n")+"\n"); err != nil {
+			return err
+		}
+		repair = true
+	}
+	if !repair {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, l := range valid {
+		b.WriteString(l.text)
+		b.WriteByte('\n')
+	}
+	if err = replaceFile(filename, b.String()); err != nil {
+		return err
+	}
+	report.Repaired++
+	log.Printf("%s: repaired", filename)
+	return nil
+}
+
+func appendToFile(filename string, content string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Replace the content of a file by writing a new file and renaming it
+func replaceFile(filename string, content string) error {
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, []byte(content), 0644); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	f, err := os.OpenFile(tmpFilename, os.O_RDWR, 0644)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
@@ -0,0 +1,220 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fsckStart = time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)
+
+// Value line at the given minute after fsckStart
+func valueLine(minute int) string {
+	return formatTimestamp(fsckStart.Add(time.Duration(minute)*time.Minute)) + ",20.00,1000.00,50.00"
+}
+
+func lines(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
+
+func writeTestFile(t *testing.T, filename string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Content of a file; "" if it does not exist
+func readTestFile(t *testing.T, filename string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCheckFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		repaired  string
+		malformed string
+		report    FsckReport
+	}{
+		{
+			name:     "valid",
+			content:  lines(valueLine(0), valueLine(1)),
+			repaired: lines(valueLine(0), valueLine(1)),
+			report:   FsckReport{Files: 1, Lines: 2},
+		},
+		{
+			name:      "truncated last line",
+			content:   lines(valueLine(0), valueLine(1)) + valueLine(2)[:15],
+			repaired:  lines(valueLine(0), valueLine(1)),
+			malformed: lines(valueLine(2)[:15]),
+			report:    FsckReport{Files: 1, Lines: 3, Malformed: 1, Repaired: 1},
+		},
+		{
+			name:      "garbage lines",
+			content:   lines(valueLine(0), "\x00\x00\x00", valueLine(1), valueLine(2)+",abc", valueLine(3)),
+			repaired:  lines(valueLine(0), valueLine(1), valueLine(3)),
+			malformed: lines("\x00\x00\x00", valueLine(2)+",abc"),
+			report:    FsckReport{Files: 1, Lines: 5, Malformed: 2, Repaired: 1},
+		},
+		{
+			name:      "value missing",
+			content:   lines(valueLine(0), formatTimestamp(fsckStart)+",,1000.00,50.00"),
+			repaired:  lines(valueLine(0)),
+			malformed: lines(formatTimestamp(fsckStart) + ",,1000.00,50.00"),
+			report:    FsckReport{Files: 1, Lines: 2, Malformed: 1, Repaired: 1},
+		},
+		{
+			name:     "unordered",
+			content:  lines(valueLine(0), valueLine(2), valueLine(1)),
+			repaired: lines(valueLine(0), valueLine(1), valueLine(2)),
+			report:   FsckReport{Files: 1, Lines: 3, Unordered: 1, Repaired: 1},
+		},
+		{
+			name:     "empty lines",
+			content:  lines(valueLine(0), "", valueLine(1)),
+			repaired: lines(valueLine(0), valueLine(1)),
+			report:   FsckReport{Files: 1, Lines: 2, Repaired: 1},
+		},
+		{
+			name:     "no line break after the last line",
+			content:  lines(valueLine(0)) + valueLine(1),
+			repaired: lines(valueLine(0), valueLine(1)),
+			report:   FsckReport{Files: 1, Lines: 2, Repaired: 1},
+		},
+		{
+			name:   "empty file",
+			report: FsckReport{Files: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "2021-08.csv")
+			writeTestFile(t, filename, test.content)
+			var report FsckReport
+			if err := checkFile(filename, validateValueLine, &report); err != nil {
+				t.Fatal(err)
+			}
+			if report != test.report {
+				t.Errorf("report %+v, expected %+v", report, test.report)
+			}
+			if content := readTestFile(t, filename); content != test.repaired {
+				t.Errorf("content %q, expected %q", content, test.repaired)
+			}
+			if malformed := readTestFile(t, filename+".malformed"); malformed != test.malformed {
+				t.Errorf("malformed lines %q, expected %q", malformed, test.malformed)
+			}
+			if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary file left: %v", err)
+			}
+		})
+	}
+}
+
+// Value, ADC and rollup files are checked; other files are left alone
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir, []string{DefaultSensor}, ROTATION_MONTH, FORMAT_CSV, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensorDir := s.sensorDir(DefaultSensor)
+	rollup := formatTimestamp(fsckStart) + ",1,2,1.5,2,,,,,,,,,,,,"
+	files := map[string]struct{ content, repaired string }{
+		"2021-08.csv":       {lines(valueLine(1), valueLine(0)) + "2021-08-28T", lines(valueLine(0), valueLine(1))},
+		"2021-09.csv":       {lines(valueLine(0)), lines(valueLine(0))},
+		"adc-2021-08.csv":   {lines(formatTimestamp(fsckStart)+",1,2,3,4,0,0", "x"), lines(formatTimestamp(fsckStart) + ",1,2,3,4,0,0")},
+		"daily.csv":         {lines(rollup, formatTimestamp(fsckStart)+",1,2"), lines(rollup)},
+		"hourly-2021.csv":   {lines(rollup), lines(rollup)},
+		"notes.csv":         {"not checked", "not checked"},
+		"2021-08.csv.extra": {"not checked", "not checked"},
+	}
+	for name, f := range files {
+		writeTestFile(t, filepath.Join(sensorDir, name), f.content)
+	}
+
+	report, err := s.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FsckReport{Files: 5, Lines: 9, Malformed: 3, Unordered: 1, Repaired: 3}
+	if report != expected {
+		t.Errorf("report %+v, expected %+v", report, expected)
+	}
+	for name, f := range files {
+		if content := readTestFile(t, filepath.Join(sensorDir, name)); content != f.repaired {
+			t.Errorf("%s: content %q, expected %q", name, content, f.repaired)
+		}
+	}
+	if malformed := readTestFile(t, filepath.Join(sensorDir, "2021-08.csv.malformed")); malformed != "2021-08-28T\n" {
+		t.Errorf("malformed lines %q", malformed)
+	}
+}
+
+// A line truncated by a power cut is terminated before the next append,
+// so that only this line is malformed
+func TestAppendAfterTruncatedLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"new file", "", lines(valueLine(2))},
+		{"complete lines", lines(valueLine(0)), lines(valueLine(0), valueLine(2))},
+		{"truncated line", lines(valueLine(0)) + valueLine(1)[:20], lines(valueLine(0), valueLine(1)[:20], valueLine(2))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), DefaultSensor, "2021-08.csv")
+			if test.content != "" {
+				writeTestFile(t, filename, test.content)
+			}
+			if err := appendLine(filename, strings.Split(valueLine(2), ",")); err != nil {
+				t.Fatal(err)
+			}
+			if content := readTestFile(t, filename); content != test.expected {
+				t.Errorf("content %q, expected %q", content, test.expected)
+			}
+
+			var times []time.Time
+			err := scanDataFile(filename, time.Time{}, endOfTime, func(t time.Time, line []string) error {
+				times = append(times, t)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(times) == 0 || !times[len(times)-1].Equal(fsckStart.Add(2*time.Minute)) {
+				t.Errorf("read %v, expected the appended line last", times)
+			}
+		})
+	}
+}
+
+// Malformed lines are skipped when reading
+func TestScanDataFileSkipsMalformedLines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "2021-08.csv")
+	writeTestFile(t, filename, lines(valueLine(0), "garbage", valueLine(1), "\x00\x00", valueLine(2))+valueLine(3)[:10])
+	var times []time.Time
+	err := scanDataFile(filename, time.Time{}, endOfTime, func(t time.Time, line []string) error {
+		times = append(times, t)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 3 {
+		t.Errorf("read %d lines, expected 3: %v", len(times), times)
+	}
+}
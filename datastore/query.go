@@ -0,0 +1,281 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Aggregations of the values within a bucket
+const (
+	AGGREGATION_AVG  = "avg"
+	AGGREGATION_MIN  = "min"
+	AGGREGATION_MAX  = "max"
+	AGGREGATION_LAST = "last"
+	AGGREGATION_SUM  = "sum"
+)
+
+// Series of several channels of a sensor within [Start, End)
+type SeriesQuery struct {
+	Sensor   string
+	Channels []CsvPos
+	Start    time.Time
+	End      time.Time
+	// Values are aggregated per bucket; 0 returns every stored value.
+	// Buckets of whole days start at midnight in the time zone of Start.
+	Bucket      time.Duration
+	Aggregation string
+}
+
+func (q SeriesQuery) Validate() error {
+	if len(q.Channels) == 0 {
+		return fmt.Errorf("no channels")
+	}
+	for _, pos := range q.Channels {
+		if pos <= DatePos || pos > GasResistancePos {
+			return fmt.Errorf("unknown channel %d", pos)
+		}
+	}
+	if q.End.Before(q.Start) {
+		return fmt.Errorf("end before start")
+	}
+	if q.Bucket < 0 {
+		return fmt.Errorf("negative bucket")
+	}
+	switch q.Aggregation {
+	case AGGREGATION_AVG, AGGREGATION_MIN, AGGREGATION_MAX, AGGREGATION_LAST, AGGREGATION_SUM:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregation %q", q.Aggregation)
+}
+
+// Start of the bucket containing t
+func (q SeriesQuery) bucketStart(t time.Time) time.Time {
+	const day = 24 * time.Hour
+	if q.Bucket == 0 {
+		return t
+	}
+	if q.Bucket%day != 0 {
+		return q.Start.Add(t.Sub(q.Start) / q.Bucket * q.Bucket)
+	}
+	// calendar days, so that buckets start at midnight across DST changes
+	loc := q.Start.Location()
+	midnight := func(t time.Time) time.Time {
+		y, m, d := t.In(loc).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	first := midnight(q.Start)
+	days := int(math.Round(midnight(t).Sub(first).Hours() / 24))
+	return first.AddDate(0, 0, days-days%int(q.Bucket/day))
+}
+
+// Rollups are read instead of the stored values if the buckets consist of
+// whole periods; they have no last value.
+func (q SeriesQuery) rollupPeriod(loc *time.Location) (rollupPeriod, bool) {
+	if q.Aggregation == AGGREGATION_LAST {
+		return rollupPeriod{}, false
+	}
+	for _, pos := range q.Channels {
+		if rollupColumn(pos) < 0 {
+			return rollupPeriod{}, false
+		}
+	}
+	var p rollupPeriod
+	switch {
+	case q.Bucket > 0 && q.Bucket%(24*time.Hour) == 0:
+		p = daily
+	case q.Bucket > 0 && q.Bucket%time.Hour == 0:
+		p = hourly
+	default:
+		return rollupPeriod{}, false
+	}
+	return p, p.start(q.Start, loc).Equal(q.Start)
+}
+
+// First column of the channel in a rollup line; -1 for channels without rollup
+func rollupColumn(pos CsvPos) int {
+	for i, c := range rollupChannels {
+		if c == pos {
+			return 1 + i*columnsPerChannel
+		}
+	}
+	return -1
+}
+
+// Aggregation of one channel within the current bucket
+type bucketSeries struct {
+	start  time.Time
+	values channelRollup
+	last   float64
+	result []Entry
+}
+
+func (b *bucketSeries) add(start time.Time, c channelRollup, last float64, aggregation string) {
+	if !start.Equal(b.start) {
+		b.flush(aggregation)
+		b.start = start
+	}
+	if b.values.count == 0 || c.min < b.values.min {
+		b.values.min = c.min
+	}
+	if b.values.count == 0 || c.max > b.values.max {
+		b.values.max = c.max
+	}
+	b.values.sum += c.sum
+	b.values.count += c.count
+	b.last = last
+}
+
+func (b *bucketSeries) flush(aggregation string) {
+	c := b.values
+	if c.count == 0 {
+		return
+	}
+	var v float32
+	switch aggregation {
+	case AGGREGATION_AVG:
+		v = avg(c.sum, c.count)
+	case AGGREGATION_MIN:
+		v = float32(c.min)
+	case AGGREGATION_MAX:
+		v = float32(c.max)
+	case AGGREGATION_LAST:
+		v = float32(b.last)
+	case AGGREGATION_SUM:
+		v = float32(c.sum)
+	}
+	b.result = append(b.result, Entry{Time: b.start, Value: v})
+	b.values = channelRollup{}
+}
+
+// One series per channel in the order of the query, read in one pass.
+// Channels the sensor does not measure have an empty series.
+func (s *Store) QuerySeries(q SeriesQuery) ([][]Entry, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	series := make([]bucketSeries, len(q.Channels))
+	var err error
+	if p, ok := q.rollupPeriod(s.location); ok {
+		// rollups are written when their period is complete, so the
+		// values after the last rollup are read from the stored values
+		rolledUp := s.rolledUpUntil(q.Sensor, p)
+		rollupQuery := q
+		if rolledUp.Before(q.End) {
+			rollupQuery.End = rolledUp
+		}
+		err = s.scanRollups(rollupQuery, p, series)
+		if err == nil && rolledUp.Before(q.End) {
+			start := q.Start
+			if rolledUp.After(start) {
+				start = rolledUp
+			}
+			err = s.scanValues(q, start, series)
+		}
+	} else {
+		err = s.scanValues(q, q.Start, series)
+	}
+	if err != nil {
+		log.Println("Error: ", err)
+		return nil, err
+	}
+
+	result := make([][]Entry, len(series))
+	for i := range series {
+		series[i].flush(q.Aggregation)
+		result[i] = series[i].result
+		if result[i] == nil {
+			result[i] = make([]Entry, 0)
+		}
+	}
+	log.Printf("Get %d series of sensor %s with %s per %v", len(result), q.Sensor, q.Aggregation, q.Bucket)
+	return result, nil
+}
+
+// Add the stored values from start up to the end of the query
+func (s *Store) scanValues(q SeriesQuery, start time.Time, series []bucketSeries) error {
+	return s.backend.scan(q.Sensor, start, q.End, func(r record) error {
+		start := q.bucketStart(r.t)
+		for i, pos := range q.Channels {
+			if v, ok := r.value(pos); ok {
+				f := float64(v)
+				series[i].add(start, channelRollup{min: f, max: f, sum: f, count: 1}, f, q.Aggregation)
+			}
+		}
+		return nil
+	})
+}
+
+// End of the period of the last written rollup; zero without rollups
+func (s *Store) rolledUpUntil(sensor string, p rollupPeriod) time.Time {
+	files, err := filepath.Glob(p.pattern(s.sensorDir(sensor)))
+	if err != nil || len(files) == 0 {
+		return time.Time{}
+	}
+	line, err := lastLine(files[len(files)-1])
+	if err != nil || line == "" {
+		return time.Time{}
+	}
+	t := lineTime(line)
+	if t.IsZero() {
+		return t
+	}
+	return p.next(p.start(t, s.location))
+}
+
+func (s *Store) scanRollups(q SeriesQuery, p rollupPeriod, series []bucketSeries) error {
+	files, err := filepath.Glob(p.pattern(s.sensorDir(q.Sensor)))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = scanDataFile(file, q.Start, q.End, func(t time.Time, line []string) error {
+			if len(line) != 1+len(rollupChannels)*columnsPerChannel {
+				return errMalformedLine
+			}
+			start := q.bucketStart(t)
+			for i, pos := range q.Channels {
+				column := rollupColumn(pos)
+				// channel not measured by the sensor
+				if line[column+countColumn] == "" {
+					continue
+				}
+				c, err := parseChannelRollup(line[column : column+columnsPerChannel])
+				if err != nil {
+					return errMalformedLine
+				}
+				series[i].add(start, c, 0, q.Aggregation)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Min, max, avg and count columns
+func parseChannelRollup(columns []string) (channelRollup, error) {
+	var values [avgColumn + 1]float64
+	for i := range values {
+		v, err := strconv.ParseFloat(columns[i], 64)
+		if err != nil {
+			return channelRollup{}, err
+		}
+		values[i] = v
+	}
+	count, err := strconv.Atoi(columns[countColumn])
+	if err != nil {
+		return channelRollup{}, err
+	}
+	return channelRollup{
+		min:   values[minColumn],
+		max:   values[maxColumn],
+		sum:   values[avgColumn] * float64(count),
+		count: count,
+	}, nil
+}
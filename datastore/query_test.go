@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+// The current day is not rolled up yet and is read from the stored values
+func TestQuerySeriesIncludesCurrentPeriod(t *testing.T) {
+	for _, format := range []string{FORMAT_CSV, FORMAT_BINARY} {
+		t.Run(format, func(t *testing.T) {
+			s, err := NewStore(t.TempDir(), []string{DefaultSensor}, ROTATION_DAY, format, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			today := daily.start(now, time.Local)
+			start := today.AddDate(0, 0, -3)
+			n := int(now.Sub(start) / benchStep)
+			appendTestValues(t, s, start, n, benchStep)
+			if err = s.RebuildRollups(DefaultSensor); err != nil {
+				t.Fatal(err)
+			}
+			last := start.Add(time.Duration(n-1) * benchStep)
+
+			tests := []struct {
+				bucket time.Duration
+				// start of the last bucket
+				last time.Time
+			}{
+				{24 * time.Hour, daily.start(last, time.Local)},
+				{time.Hour, hourly.start(last, time.Local)},
+			}
+			for _, test := range tests {
+				q := SeriesQuery{
+					Sensor:      DefaultSensor,
+					Channels:    []CsvPos{TemperaturePos},
+					Start:       start,
+					End:         today.AddDate(0, 0, 1),
+					Bucket:      test.bucket,
+					Aggregation: AGGREGATION_MAX,
+				}
+				series, err := s.QuerySeries(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries := series[0]
+				if len(entries) == 0 || !entries[len(entries)-1].Time.Equal(test.last) {
+					t.Fatalf("bucket %v: last entry %v, expected %v", test.bucket, entries, test.last)
+				}
+				// rollups and the stored values of the current period are not counted twice
+				q.Aggregation = AGGREGATION_SUM
+				q.Channels = []CsvPos{HumidityPos}
+				series, err = s.QuerySeries(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var sum, expected float64
+				for _, e := range series[0] {
+					sum += float64(e.Value)
+				}
+				for i := 0; i < n; i++ {
+					expected += float64(testResult(i).Humidity)
+				}
+				if sum < expected*0.999 || sum > expected*1.001 {
+					t.Errorf("bucket %v: sum %.1f, expected %.1f", test.bucket, sum, expected)
+				}
+			}
+		})
+	}
+}
+
+var queryStart = time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)
+
+// Temperatures at minutes after queryStart, without humidity
+func appendTemperatures(t *testing.T, s *Store, temperatures map[int]float32) {
+	t.Helper()
+	records := make([]record, 0, len(temperatures))
+	for minute := 0; minute < 24*60; minute++ {
+		if v, ok := temperatures[minute]; ok {
+			res := bme280.Result{Temperature: v, Pressure: 1000}
+			records = append(records, record{t: queryStart.Add(time.Duration(minute) * time.Minute), res: res, raw: res})
+		}
+	}
+	if err := s.backend.append(DefaultSensor, records...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuerySeriesAggregations(t *testing.T) {
+	s, err := NewStore(t.TempDir(), []string{DefaultSensor}, ROTATION_DAY, FORMAT_CSV, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing between 11:00 and 12:00
+	appendTemperatures(t, s, map[int]float32{0: 20, 10: 24, 20: 22, 125: 18})
+	at := func(minute int) time.Time { return queryStart.Add(time.Duration(minute) * time.Minute) }
+
+	tests := []struct {
+		name        string
+		start, end  time.Time
+		bucket      time.Duration
+		aggregation string
+		expected    []Entry
+	}{
+		{"avg", at(0), at(180), time.Hour, AGGREGATION_AVG, []Entry{{at(0), 22}, {at(120), 18}}},
+		{"min", at(0), at(180), time.Hour, AGGREGATION_MIN, []Entry{{at(0), 20}, {at(120), 18}}},
+		{"max", at(0), at(180), time.Hour, AGGREGATION_MAX, []Entry{{at(0), 24}, {at(120), 18}}},
+		{"sum", at(0), at(180), time.Hour, AGGREGATION_SUM, []Entry{{at(0), 66}, {at(120), 18}}},
+		{"last", at(0), at(180), time.Hour, AGGREGATION_LAST, []Entry{{at(0), 22}, {at(120), 18}}},
+		{"partial bucket at the end", at(0), at(15), time.Hour, AGGREGATION_MAX, []Entry{{at(0), 24}}},
+		{"buckets from an unaligned start", at(5), at(180), time.Hour, AGGREGATION_AVG, []Entry{{at(5), 23}, {at(125), 18}}},
+		{"every value", at(0), at(180), 0, AGGREGATION_AVG, []Entry{{at(0), 20}, {at(10), 24}, {at(20), 22}, {at(125), 18}}},
+		{"no values", at(30), at(120), time.Hour, AGGREGATION_AVG, []Entry{}},
+	}
+	check := func(t *testing.T, rollups string) {
+		for _, test := range tests {
+			q := SeriesQuery{
+				Sensor:      DefaultSensor,
+				Channels:    []CsvPos{TemperaturePos, HumidityPos},
+				Start:       test.start,
+				End:         test.end,
+				Bucket:      test.bucket,
+				Aggregation: test.aggregation,
+			}
+			series, err := s.QuerySeries(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalEntries(series[0], test.expected) {
+				t.Errorf("%s %s: %v, expected %v", test.name, rollups, series[0], test.expected)
+			}
+			// the humidity is not measured
+			if series[1] == nil || len(series[1]) != 0 {
+				t.Errorf("%s %s: humidity %v", test.name, rollups, series[1])
+			}
+		}
+	}
+	check(t, "without rollups")
+	if err = s.RebuildRollups(DefaultSensor); err != nil {
+		t.Fatal(err)
+	}
+	if until := s.rolledUpUntil(DefaultSensor, hourly); !until.Equal(at(180)) {
+		t.Fatalf("rolled up until %v", until)
+	}
+	check(t, "with rollups")
+}
+
+// Buckets of days start at midnight, also after a day of 25 hours
+func TestQuerySeriesDaysAcrossDST(t *testing.T) {
+	berlin := setLocal(t, "Europe/Berlin")
+	s, err := NewStore(t.TempDir(), []string{DefaultSensor}, ROTATION_DAY, FORMAT_CSV, berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noon := func(day int) time.Time { return time.Date(2021, 10, day, 12, 0, 0, 0, berlin) }
+	midnight := func(day int) time.Time { return time.Date(2021, 10, day, 0, 0, 0, 0, berlin) }
+	var records []record
+	for day := 30; day <= 32; day++ {
+		res := bme280.Result{Temperature: float32(day), Pressure: 1000}
+		records = append(records, record{t: noon(day), res: res, raw: res})
+	}
+	if err = s.backend.append(DefaultSensor, records...); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		bucket   time.Duration
+		expected []Entry
+	}{
+		{24 * time.Hour, []Entry{{midnight(30), 30}, {midnight(31), 31}, {midnight(32), 32}}},
+		{48 * time.Hour, []Entry{{midnight(30), 31}, {midnight(32), 32}}},
+	}
+	for _, test := range tests {
+		q := SeriesQuery{
+			Sensor:      DefaultSensor,
+			Channels:    []CsvPos{TemperaturePos},
+			Start:       midnight(30),
+			End:         midnight(33),
+			Bucket:      test.bucket,
+			Aggregation: AGGREGATION_LAST,
+		}
+		series, err := s.QuerySeries(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalEntries(series[0], test.expected) {
+			t.Errorf("bucket %v: %v, expected %v", test.bucket, series[0], test.expected)
+		}
+	}
+}
+
+func TestSeriesQueryValidate(t *testing.T) {
+	valid := SeriesQuery{
+		Sensor:      DefaultSensor,
+		Channels:    []CsvPos{TemperaturePos},
+		Start:       queryStart,
+		End:         queryStart.Add(time.Hour),
+		Aggregation: AGGREGATION_AVG,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(q *SeriesQuery)
+	}{
+		{"no channels", func(q *SeriesQuery) { q.Channels = nil }},
+		{"date channel", func(q *SeriesQuery) { q.Channels = []CsvPos{DatePos} }},
+		{"unknown channel", func(q *SeriesQuery) { q.Channels = []CsvPos{GasResistancePos + 1} }},
+		{"end before start", func(q *SeriesQuery) { q.End = q.Start.Add(-time.Second) }},
+		{"negative bucket", func(q *SeriesQuery) { q.Bucket = -time.Hour }},
+		{"unknown aggregation", func(q *SeriesQuery) { q.Aggregation = "median" }},
+	}
+	for _, test := range tests {
+		q := valid
+		test.modify(&q)
+		if err := q.Validate(); err == nil {
+			t.Errorf("%s: valid", test.name)
+		}
+	}
+}
+
+func equalEntries(a, b []Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
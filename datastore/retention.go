@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Days to keep stored values; 0 keeps them forever
+type RetentionPolicy struct {
+	// Values and ADC values of every reading
+	RawDays    int `yaml:"rawDays"`
+	HourlyDays int `yaml:"hourlyDays"`
+	DailyDays  int `yaml:"dailyDays"`
+}
+
+func (p RetentionPolicy) Validate() error {
+	if p.RawDays < 0 || p.HourlyDays < 0 || p.DailyDays < 0 {
+		return fmt.Errorf("retention days must not be negative")
+	}
+	return nil
+}
+
+const retentionInterval = 24 * time.Hour
+
+// Apply the policy now and once a day in the background
+func (s *Store) StartRetention(policy RetentionPolicy) {
+	go func() {
+		for {
+			s.ApplyRetention(policy, time.Now())
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+// Remove all values which are older than the policy allows
+func (s *Store) ApplyRetention(policy RetentionPolicy, now time.Time) {
+	for _, sensor := range s.sensorNames {
+		if policy.RawDays > 0 {
+			cutoff := now.AddDate(0, 0, -policy.RawDays)
+			// values are only removed if the daily rollups contain them
+			if !s.coveredByRollups(sensor) {
+				log.Printf("Retention: daily rollups of sensor %s are incomplete, keeping values; use -rebuildRollups", sensor)
+				cutoff = time.Time{}
+			}
+			if !cutoff.IsZero() {
+				s.removeValuesBefore(sensor, cutoff)
+				files, _ := filepath.Glob(s.sensorDir(sensor) + "/" + adcPrefix + "*" + csvSuffix)
+				for _, file := range files {
+					if _, _, ok := s.parsePeriod(strings.TrimPrefix(filepath.Base(file), adcPrefix)); ok {
+						s.removeBefore(file, cutoff)
+					}
+				}
+			}
+		}
+		if policy.HourlyDays > 0 {
+			files, _ := filepath.Glob(hourly.pattern(s.sensorDir(sensor)))
+			for _, file := range files {
+				s.removeBefore(file, now.AddDate(0, 0, -policy.HourlyDays))
+			}
+		}
+		if policy.DailyDays > 0 {
+			files, _ := filepath.Glob(daily.pattern(s.sensorDir(sensor)))
+			for _, file := range files {
+				s.removeBefore(file, now.AddDate(0, 0, -policy.DailyDays))
+			}
+		}
+	}
+}
+
+// Whether the daily rollups start not later than the stored values
+func (s *Store) coveredByRollups(sensor string) bool {
+	firstValue, err := s.backend.first(sensor)
+	if err != nil || firstValue.IsZero() {
+		return false
+	}
+	firstRollup, err := firstTime(daily.filename(s.sensorDir(sensor), firstValue))
+	if err != nil || firstRollup.IsZero() {
+		return false
+	}
+	return !firstRollup.After(daily.start(firstValue, s.location))
+}
+
+func (s *Store) removeValuesBefore(sensor string, cutoff time.Time) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := s.backend.removeBefore(sensor, cutoff); err != nil {
+		log.Printf("Retention of sensor %s failed: %v", sensor, err)
+	}
+}
+
+// Remove the lines before cutoff from a time ordered file. The remaining
+// lines are copied into a new file which replaces the old one, so the
+// file is complete at any time.
+func (s *Store) removeBefore(filename string, cutoff time.Time) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if err := rewriteFrom(filename, cutoff); err != nil {
+		log.Printf("Retention of %s failed: %v", filename, err)
+	}
+}
+
+func rewriteFrom(filename string, cutoff time.Time) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := seekTime(f, info.Size(), cutoff)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		return nil
+	}
+	if offset == info.Size() {
+		log.Printf("Retention: removing %s", filename)
+		return os.Remove(filename)
+	}
+
+	tmpFilename := filename + ".tmp"
+	out, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, io.NewSectionReader(f, offset, info.Size()-offset)); err != nil {
+		out.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	log.Printf("Retention: removed %d bytes from %s", offset, filename)
+	return os.Rename(tmpFilename, filename)
+}
+
+// Cut a time ordered file before the first line not before t and return
+// the time of the last remaining line
+func truncateFrom(filename string, t time.Time) (time.Time, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return time.Time{}, err
+	}
+	offset, err := seekTime(f, info.Size(), t)
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	f.Close()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if offset == 0 {
+		return time.Time{}, os.Remove(filename)
+	}
+	line, err := lastLine(filename)
+	return lineTime(line), err
+}
@@ -0,0 +1,296 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/**
+ * Hourly and daily rollups with min, max, average and count per channel.
+ * A rollup is written as soon as its hour or day is complete and is used
+ * for buckets of at least an hour or a day instead of the raw values:
+ *   <dir>/<sensor>/hourly-2021.csv
+ *   <dir>/<sensor>/daily.csv
+ * Columns: start of the period, then min, max, avg and count for
+ * temperature, pressure, humidity and gas resistance.
+**/
+
+// Channels of a rollup in column order
+var rollupChannels = []CsvPos{TemperaturePos, PressurePos, HumidityPos, GasResistancePos}
+
+// Columns per channel
+const (
+	minColumn = iota
+	maxColumn
+	avgColumn
+	countColumn
+	columnsPerChannel
+)
+
+type rollupPeriod struct {
+	name string
+	// Start of the period containing t in the time zone loc
+	start func(t time.Time, loc *time.Location) time.Time
+	// Start of the following period
+	next func(start time.Time) time.Time
+	// File in the sensor directory of the period starting at start
+	filename func(sensorDir string, start time.Time) string
+	// Glob pattern matching all files in the sensor directory
+	pattern func(sensorDir string) string
+}
+
+var hourly = rollupPeriod{
+	name: "hourly",
+	start: func(t time.Time, loc *time.Location) time.Time {
+		// by the offset of t, as the hour is repeated when summer time ends
+		_, offset := t.In(loc).Zone()
+		d := time.Duration(offset) * time.Second
+		return t.Add(d).Truncate(time.Hour).Add(-d).In(loc)
+	},
+	next: func(start time.Time) time.Time {
+		return start.Add(time.Hour)
+	},
+	filename: func(sensorDir string, start time.Time) string {
+		return sensorDir + "/hourly-" + start.Format("2006") + csvSuffix
+	},
+	pattern: func(sensorDir string) string {
+		return sensorDir + "/hourly-*" + csvSuffix
+	},
+}
+
+var daily = rollupPeriod{
+	name: "daily",
+	start: func(t time.Time, loc *time.Location) time.Time {
+		t = t.In(loc)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	},
+	next: func(start time.Time) time.Time {
+		return start.AddDate(0, 0, 1)
+	},
+	filename: func(sensorDir string, start time.Time) string {
+		return sensorDir + "/daily" + csvSuffix
+	},
+	pattern: func(sensorDir string) string {
+		return sensorDir + "/daily" + csvSuffix
+	},
+}
+
+var rollupPeriods = []rollupPeriod{hourly, daily}
+
+type channelRollup struct {
+	min   float64
+	max   float64
+	sum   float64
+	count int
+}
+
+func (c *channelRollup) add(v float64) {
+	if c.count == 0 || v < c.min {
+		c.min = v
+	}
+	if c.count == 0 || v > c.max {
+		c.max = v
+	}
+	c.sum += v
+	c.count++
+}
+
+type rollup [4]channelRollup
+
+func (r *rollup) add(rec record) {
+	for i, pos := range rollupChannels {
+		if v, ok := rec.value(pos); ok {
+			r[i].add(float64(v))
+		}
+	}
+}
+
+func (r *rollup) isEmpty() bool {
+	for _, c := range r {
+		if c.count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rollup) toColumns(start time.Time) []string {
+	column := []string{formatTimestamp(start)}
+	for _, c := range r {
+		if c.count == 0 {
+			column = append(column, "", "", "", "")
+			continue
+		}
+		column = append(column,
+			fmt.Sprintf("%.2f", c.min),
+			fmt.Sprintf("%.2f", c.max),
+			fmt.Sprintf("%.2f", c.sum/float64(c.count)),
+			strconv.Itoa(c.count))
+	}
+	return column
+}
+
+// Write the rollups of all periods which are complete at time now; callers hold fileLock
+func (s *Store) updateRollups(sensor string, now time.Time) {
+	next, ok := s.nextRollups[sensor]
+	if !ok {
+		next = make([]time.Time, len(rollupPeriods))
+		for i, p := range rollupPeriods {
+			next[i] = s.initialRollup(sensor, p, now)
+		}
+		s.nextRollups[sensor] = next
+	}
+	for i, p := range rollupPeriods {
+		for next[i].Before(p.start(now, s.location)) {
+			end := p.next(next[i])
+			r, err := s.computeRollup(sensor, next[i], end)
+			if err == nil && !r.isEmpty() {
+				err = appendLine(p.filename(s.sensorDir(sensor), next[i]), r.toColumns(next[i]))
+			}
+			if err != nil {
+				log.Printf("Error: %s rollup of sensor %s: %v", p.name, sensor, err)
+				break
+			}
+			next[i] = end
+		}
+	}
+}
+
+// The period after the last written rollup; the current period if there is none
+func (s *Store) initialRollup(sensor string, p rollupPeriod, now time.Time) time.Time {
+	files, _ := filepath.Glob(p.pattern(s.sensorDir(sensor)))
+	if len(files) > 0 {
+		line, err := lastLine(files[len(files)-1])
+		if err == nil && line != "" {
+			if t := lineTime(line); !t.IsZero() {
+				return p.next(t)
+			}
+		}
+	}
+	log.Printf("No %s rollups for sensor %s; use -rebuildRollups to include older values", p.name, sensor)
+	return p.start(now, s.location)
+}
+
+func (s *Store) computeRollup(sensor string, start, end time.Time) (rollup, error) {
+	var r rollup
+	err := s.backend.scan(sensor, start, end, func(rec record) error {
+		r.add(rec)
+		return nil
+	})
+	return r, err
+}
+
+// Time of the first line of a file
+func firstTime(filename string) (time.Time, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, line, err := lineAt(f, 0, info.Size())
+	return lineTime(line), err
+}
+
+// Last line of a file without the line break
+func lastLine(filename string) (string, error) {
+	lines, err := tailLines(filename, 1)
+	if err != nil || len(lines) == 0 {
+		return "", err
+	}
+	return lines[0], nil
+}
+
+// Recalculate the rollups of the sensor from the raw values. Rollups of
+// periods before the first raw value are kept; the raw values may have
+// been removed by the retention policy.
+func (s *Store) RebuildRollups(sensor string) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	return s.rebuildRollups(sensor)
+}
+
+func (s *Store) rebuildRollups(sensor string) error {
+	first, err := s.backend.first(sensor)
+	if err != nil {
+		return err
+	}
+	if first.IsZero() {
+		// the retention policy may have removed all values
+		log.Printf("No values of sensor %s; keeping its rollups", sensor)
+		return nil
+	}
+
+	// last kept rollup per period
+	kept := make([]time.Time, len(rollupPeriods))
+	for i, p := range rollupPeriods {
+		rollupFiles, err := filepath.Glob(p.pattern(s.sensorDir(sensor)))
+		if err != nil {
+			return err
+		}
+		// a rollup of the period of the first value is kept if the period started before it
+		boundary := p.start(first, s.location)
+		if boundary.Before(first) {
+			boundary = p.next(boundary)
+		}
+		for _, file := range rollupFiles {
+			last, err := truncateFrom(file, boundary)
+			if err != nil {
+				return err
+			}
+			if last.After(kept[i]) {
+				kept[i] = last
+			}
+		}
+	}
+
+	now := time.Now()
+	current := make([]rollup, len(rollupPeriods))
+	starts := make([]time.Time, len(rollupPeriods))
+	flush := func(i int) error {
+		if starts[i].IsZero() || !starts[i].After(kept[i]) || current[i].isEmpty() {
+			return nil
+		}
+		p := rollupPeriods[i]
+		return appendLine(p.filename(s.sensorDir(sensor), starts[i]), current[i].toColumns(starts[i]))
+	}
+	count := 0
+	err = s.backend.scan(sensor, time.Time{}, endOfTime, func(rec record) error {
+		for i, p := range rollupPeriods {
+			if start := p.start(rec.t, s.location); !start.Equal(starts[i]) {
+				if err := flush(i); err != nil {
+					return err
+				}
+				current[i] = rollup{}
+				starts[i] = start
+			}
+			current[i].add(rec)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the current period is written when it is complete
+	next := make([]time.Time, len(rollupPeriods))
+	for i, p := range rollupPeriods {
+		next[i] = p.start(now, s.location)
+		if starts[i].Before(next[i]) {
+			if err = flush(i); err != nil {
+				return err
+			}
+		}
+	}
+	s.nextRollups[sensor] = next
+	log.Printf("Rebuilt rollups of sensor %s from %d values", sensor, count)
+	return nil
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * Lines of a data file are ordered by time. A binary search over the byte
+ * offsets finds the first line of a time range without reading the lines
+ * in front of it; the query then streams until the end of the range.
+**/
+
+// Offset of the first line with a time not before start. A malformed line
+// may be returned instead of a following line, but no line after start is
+// skipped; callers skip malformed lines.
+func seekTime(r io.ReaderAt, size int64, start time.Time) (int64, error) {
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		lineStart, line, err := lineAt(r, mid, size)
+		if err != nil {
+			return 0, err
+		}
+		if t := lineTime(line); lineStart < size && !t.IsZero() && t.Before(start) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	lineStart, _, err := lineAt(r, lo, size)
+	return lineStart, err
+}
+
+// First complete line starting at or after offset; lineStart is size if there is none
+func lineAt(r io.ReaderAt, offset, size int64) (lineStart int64, line string, err error) {
+	lineStart = offset
+	if offset > 0 {
+		// the line starts after the previous newline
+		b := bufio.NewReaderSize(io.NewSectionReader(r, offset-1, size-offset+1), 256)
+		skipped, err := b.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		lineStart = offset - 1 + int64(len(skipped))
+	}
+	if lineStart >= size {
+		return size, "", nil
+	}
+	b := bufio.NewReaderSize(io.NewSectionReader(r, lineStart, size-lineStart), 256)
+	line, err = b.ReadString('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	return lineStart, line, err
+}
+
+// Time of a CSV line; zero time for lines which can not be parsed
+func lineTime(line string) time.Time {
+	if i := strings.IndexByte(line, ','); i >= 0 {
+		line = line[:i]
+	}
+	t, _ := parseTimestamp(strings.TrimSpace(line))
+	return t
+}
+
+// Bytes read per requested line and at least for the last lines of a file
+const (
+	tailLineLength = 256
+	minTailLength  = 4096
+)
+
+// Up to n complete last lines of a file without the line breaks
+func tailLines(filename string, n int) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	length := n * tailLineLength
+	if length < minTailLength {
+		length = minTailLength
+	}
+	offset := size - int64(length)
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, size-offset)
+	if _, err = f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if offset > 0 {
+		// the first line is incomplete
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var seekStart = time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)
+
+// Lines one minute apart starting at seekStart; "-" is a malformed line
+func seekLines(minutes ...int) []string {
+	lines := make([]string, len(minutes))
+	for i, m := range minutes {
+		if m < 0 {
+			lines[i] = "2021-08-28T1"
+			continue
+		}
+		lines[i] = formatTimestamp(seekStart.Add(time.Duration(m)*time.Minute)) + ",20.00,1000.00"
+	}
+	return lines
+}
+
+func TestSeekTime(t *testing.T) {
+	const malformed = -1
+	tests := []struct {
+		name  string
+		lines []string
+		// without a line break after the last line
+		noTrailingNewline bool
+		start             time.Duration
+		// index of the expected line; len(lines) for the end of the file
+		want int
+	}{
+		{"before first line", seekLines(0, 1, 2, 3, 4), false, -time.Minute, 0},
+		{"mid-file", seekLines(0, 1, 2, 3, 4), false, 90 * time.Second, 2},
+		{"after last line", seekLines(0, 1, 2, 3, 4), false, 10 * time.Minute, 5},
+		{"exact match", seekLines(0, 1, 2, 3, 4), false, 3 * time.Minute, 3},
+		{"exact match of first line", seekLines(0, 1, 2, 3, 4), false, 0, 0},
+		{"equal times", seekLines(0, 1, 1, 1, 2), false, time.Minute, 1},
+		{"malformed line at probe point", seekLines(0, 1, malformed, 3, 4), false, 3 * time.Minute, 2},
+		{"malformed line before start", seekLines(0, 1, malformed, 3, 4), false, time.Minute, 1},
+		{"malformed last line", seekLines(0, 1, 2, 3, malformed), false, 10 * time.Minute, 4},
+		{"no trailing newline", seekLines(0, 1, 2, 3, 4), true, 4 * time.Minute, 4},
+		{"no trailing newline after last line", seekLines(0, 1, 2, 3, 4), true, 5 * time.Minute, 5},
+		{"single line", seekLines(0), true, 0, 0},
+		{"empty file", nil, false, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := strings.Join(test.lines, "\n")
+			if len(test.lines) > 0 && !test.noTrailingNewline {
+				content += "\n"
+			}
+			offsets := make([]int64, len(test.lines)+1)
+			for i, line := range test.lines {
+				offsets[i+1] = offsets[i] + int64(len(line)) + 1
+			}
+			size := int64(len(content))
+			if offsets[len(test.lines)] > size {
+				offsets[len(test.lines)] = size
+			}
+			offset, err := seekTime(strings.NewReader(content), size, seekStart.Add(test.start))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != offsets[test.want] {
+				t.Errorf("offset %d, expected %d", offset, offsets[test.want])
+			}
+		})
+	}
+}
+
+func TestLineAt(t *testing.T) {
+	lines := seekLines(0, 1, 2)
+	content := strings.Join(lines, "\n")
+	size := int64(len(content))
+	second := int64(len(lines[0]) + 1)
+	third := second + int64(len(lines[1])+1)
+	tests := []struct {
+		offset    int64
+		lineStart int64
+		line      string
+	}{
+		{0, 0, lines[0] + "\n"},
+		{1, second, lines[1] + "\n"},
+		// offset at the start of a line
+		{second, second, lines[1] + "\n"},
+		// offset at the line break before a line
+		{second - 1, second, lines[1] + "\n"},
+		// last line without a line break
+		{second + 1, third, lines[2]},
+		{third + 1, size, ""},
+		{size, size, ""},
+	}
+	for _, test := range tests {
+		lineStart, line, err := lineAt(strings.NewReader(content), test.offset, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lineStart != test.lineStart || line != test.line {
+			t.Errorf("offset %d: line %q at %d, expected %q at %d", test.offset, line, lineStart, test.line, test.lineStart)
+		}
+	}
+}
+
+// The seek in a single file with a value every 5 minutes
+func BenchmarkSeekTime(b *testing.B) {
+	for _, months := range []int{1, 12, 60} {
+		b.Run(strconv.Itoa(months)+"months", func(b *testing.B) {
+			var buf bytes.Buffer
+			start := benchEnd.AddDate(0, -months, 0)
+			for t := start; t.Before(benchEnd); t = t.Add(benchStep) {
+				buf.WriteString(formatTimestamp(t) + ",20.00,1000.00,50.00,20.00,1000.00,50.00\n")
+			}
+			r := bytes.NewReader(buf.Bytes())
+			size := int64(buf.Len())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := seekTime(r, size, benchEnd.AddDate(0, 0, -2)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The time of a query of one day must not depend on the stored history
+func BenchmarkDayQuery(b *testing.B) {
+	for _, months := range []int{1, 12, 60} {
+		b.Run(strconv.Itoa(months)+"months", func(b *testing.B) {
+			s := benchStore(b, FORMAT_CSV, months)
+			q := SeriesQuery{
+				Sensor:      DefaultSensor,
+				Channels:    []CsvPos{TemperaturePos},
+				Start:       benchEnd.AddDate(0, 0, -2),
+				End:         benchEnd.AddDate(0, 0, -1),
+				Aggregation: AGGREGATION_AVG,
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				series, err := s.QuerySeries(q)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(series[0]) != int(24*time.Hour/benchStep) {
+					b.Fatalf("%d values", len(series[0]))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package datastore
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+
+	// pure Go, so the station cross-compiles without cgo
+	_ "modernc.org/sqlite"
+)
+
+/**
+ * SQLite stores the values of all sensors in <dir>/weatherstation.db with
+ * one row per sensor, channel and reading time. Times are seconds since
+ * 1970 (UTC); the view reading_values shows them with sensor and channel
+ * names for queries by hand, e.g.
+ *   SELECT time, value FROM reading_values
+ *   WHERE sensor = 'default' AND channel = 'temperature' ORDER BY time;
+**/
+
+const sqliteFilename = "weatherstation.db"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sensors (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS channels (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS readings (
+	sensor_id INTEGER NOT NULL REFERENCES sensors(id),
+	time INTEGER NOT NULL,
+	channel_id INTEGER NOT NULL REFERENCES channels(id),
+	value REAL NOT NULL,
+	PRIMARY KEY (sensor_id, time, channel_id)
+) WITHOUT ROWID;
+CREATE VIEW IF NOT EXISTS reading_values AS
+	SELECT sensors.name AS sensor, channels.name AS channel,
+		datetime(readings.time, 'unixepoch') AS time, readings.value AS value
+	FROM readings
+	JOIN sensors ON sensors.id = readings.sensor_id
+	JOIN channels ON channels.id = readings.channel_id;
+`
+
+// Stored channels; the ids are their CSV positions
+var sqliteChannels = []CsvPos{TemperaturePos, PressurePos, HumidityPos,
+	RawTemperaturePos, RawPressurePos, RawHumidityPos, GasResistancePos}
+
+// Readings in a SQLite database
+type sqliteBackend struct {
+	layout
+	db *sql.DB
+}
+
+func openSqlite(l layout) (sqliteBackend, error) {
+	db, err := sql.Open("sqlite", "file:"+l.dir+"/"+sqliteFilename+
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return sqliteBackend{}, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return sqliteBackend{}, err
+	}
+	for _, pos := range sqliteChannels {
+		if _, err = db.Exec("INSERT OR IGNORE INTO channels (id, name) VALUES (?, ?)", int(pos), pos.String()); err != nil {
+			db.Close()
+			return sqliteBackend{}, err
+		}
+	}
+	return sqliteBackend{layout: l, db: db}, nil
+}
+
+func (b sqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+func (b sqliteBackend) append(sensor string, records ...record) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT OR IGNORE INTO sensors (name) VALUES (?)", sensor); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var sensorId int64
+	if err = tx.QueryRow("SELECT id FROM sensors WHERE name = ?", sensor).Scan(&sensorId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO readings (sensor_id, time, channel_id, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range records {
+		for _, pos := range sqliteChannels {
+			// channel not measured by the sensor
+			v, ok := r.value(pos)
+			if !ok {
+				continue
+			}
+			if _, err = stmt.Exec(sensorId, r.t.Unix(), int(pos), float64(v)); err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+func (b sqliteBackend) scan(sensor string, start, end time.Time, fn func(r record) error) error {
+	// readings before start in the same second are not within the range
+	from := start.Unix()
+	if start.After(time.Unix(from, 0)) {
+		from++
+	}
+	rows, err := b.db.Query(`SELECT time, channel_id, value FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?) AND time >= ? AND time < ?
+		ORDER BY time, channel_id`, sensor, from, endUnix(end))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var current int64
+	values := make(map[CsvPos]float32)
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		r, ok := recordFromValues(time.Unix(current, 0).UTC(), values)
+		values = make(map[CsvPos]float32)
+		if !ok {
+			return nil
+		}
+		return fn(r)
+	}
+	for rows.Next() {
+		var t, channel int64
+		var v float64
+		if err = rows.Scan(&t, &channel, &v); err != nil {
+			return err
+		}
+		if t != current {
+			if err = flush(); err != nil {
+				return err
+			}
+			current = t
+		}
+		values[CsvPos(channel)] = float32(v)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Seconds of the first time not before end
+func endUnix(end time.Time) int64 {
+	t := end.Unix()
+	if end.After(time.Unix(t, 0)) {
+		t++
+	}
+	return t
+}
+
+// Record of the channel values of a reading; false without temperature or pressure
+func recordFromValues(t time.Time, values map[CsvPos]float32) (record, bool) {
+	temperature, ok := values[TemperaturePos]
+	pressure, ok2 := values[PressurePos]
+	if !ok || !ok2 {
+		return record{}, false
+	}
+	r := record{t: t}
+	r.res = bme280.Result{Temperature: temperature, Pressure: pressure}
+	if v, ok := values[HumidityPos]; ok {
+		r.res.Humidity = v
+		r.res.Channels |= bme280.CHANNEL_HUMIDITY
+	}
+	if v, ok := values[GasResistancePos]; ok {
+		r.res.GasResistance = v
+		r.res.Channels |= bme280.CHANNEL_GAS
+	}
+	// values stored without raw values are uncorrected
+	r.raw = r.res
+	if v, ok := values[RawTemperaturePos]; ok {
+		r.raw.Temperature = v
+	}
+	if v, ok := values[RawPressurePos]; ok {
+		r.raw.Pressure = v
+	}
+	if v, ok := values[RawHumidityPos]; ok {
+		r.raw.Humidity = v
+	}
+	return r, true
+}
+
+func (b sqliteBackend) first(sensor string) (time.Time, error) {
+	var t sql.NullInt64
+	err := b.db.QueryRow(`SELECT MIN(time) FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?)`, sensor).Scan(&t)
+	if err != nil || !t.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(t.Int64, 0).UTC(), nil
+}
+
+func (b sqliteBackend) last(sensor string, n int) ([]record, error) {
+	var start sql.NullInt64
+	err := b.db.QueryRow(`SELECT MIN(time) FROM (SELECT DISTINCT time FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?) ORDER BY time DESC LIMIT ?)`,
+		sensor, n).Scan(&start)
+	if err != nil || !start.Valid {
+		return nil, err
+	}
+	records := make([]record, 0, n)
+	err = b.scan(sensor, time.Unix(start.Int64, 0), endOfTime, func(r record) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+func (b sqliteBackend) removeBefore(sensor string, cutoff time.Time) error {
+	result, err := b.db.Exec(`DELETE FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?) AND time < ?`, sensor, endUnix(cutoff))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Retention: removed %d readings of sensor %s", n, sensor)
+	}
+	return nil
+}
+
+// Rewritten per month, so not all values are held in memory
+func (b sqliteBackend) rewrite(sensor string, fn func(r record) record) error {
+	start, err := b.first(sensor)
+	if err != nil || start.IsZero() {
+		return err
+	}
+	count := 0
+	for !start.After(time.Now()) {
+		end := start.AddDate(0, 1, 0)
+		records := make([]record, 0)
+		err = b.scan(sensor, start, end, func(r record) error {
+			records = append(records, fn(r))
+			return nil
+		})
+		if err == nil {
+			err = b.append(sensor, records...)
+		}
+		if err != nil {
+			return err
+		}
+		count += len(records)
+		start = end
+	}
+	log.Printf("Rewrote %d readings of sensor %s", count, sensor)
+	return nil
+}
+
+// Check the database and remove readings which are not numbers
+func (b sqliteBackend) fsck(sensor string, report *FsckReport) error {
+	var result string
+	if err := b.db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		log.Printf("%s: %s", sqliteFilename, result)
+	}
+	var count int
+	err := b.db.QueryRow(`SELECT COUNT(DISTINCT time) FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?)`, sensor).Scan(&count)
+	if err != nil {
+		return err
+	}
+	report.Lines += count
+	removed, err := b.db.Exec(`DELETE FROM readings
+		WHERE sensor_id = (SELECT id FROM sensors WHERE name = ?) AND typeof(value) NOT IN ('real', 'integer')`, sensor)
+	if err != nil {
+		return err
+	}
+	if n, _ := removed.RowsAffected(); n > 0 {
+		log.Printf("%s: removed %d readings of sensor %s which are not numbers", sqliteFilename, n, sensor)
+		report.Malformed += int(n)
+		report.Repaired++
+	}
+	return nil
+}
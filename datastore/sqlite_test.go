@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+var sqliteStart = time.Date(2021, 8, 28, 10, 0, 0, 0, time.UTC)
+
+func openTestSqlite(t *testing.T) sqliteBackend {
+	t.Helper()
+	b, err := openSqlite(layout{dir: t.TempDir(), rotation: ROTATION_MONTH, location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// Records of a sensor within [start, end)
+func scanAll(t *testing.T, b backend, sensor string, start, end time.Time) []record {
+	t.Helper()
+	records := make([]record, 0)
+	err := b.scan(sensor, start, end, func(r record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// Records one minute apart starting at sqliteStart
+func sqliteRecords(results ...bme280.Result) []record {
+	records := make([]record, len(results))
+	for i, res := range results {
+		raw := res
+		raw.Temperature += 0.5
+		records[i] = record{t: sqliteStart.Add(time.Duration(i) * time.Minute), res: res, raw: raw}
+	}
+	return records
+}
+
+func TestSqliteChannels(t *testing.T) {
+	b := openTestSqlite(t)
+	bmp280 := bme280.Result{Temperature: 20, Pressure: 1000}
+	bme := bme280.Result{Temperature: 21, Pressure: 1001, Humidity: 50, Channels: bme280.CHANNEL_HUMIDITY}
+	bme680 := bme280.Result{Temperature: 22, Pressure: 1002, Humidity: 55, GasResistance: 120000,
+		Channels: bme280.CHANNEL_HUMIDITY | bme280.CHANNEL_GAS}
+	records := sqliteRecords(bmp280, bme, bme680)
+	if err := b.append(DefaultSensor, records...); err != nil {
+		t.Fatal(err)
+	}
+
+	read := scanAll(t, b, DefaultSensor, time.Time{}, endOfTime)
+	if len(read) != len(records) {
+		t.Fatalf("%d records, expected %d", len(read), len(records))
+	}
+	for i, r := range read {
+		expected := records[i]
+		// the gas resistance has no raw value
+		expected.raw.GasResistance = expected.res.GasResistance
+		if !r.t.Equal(expected.t) || r.res != expected.res || r.raw != expected.raw {
+			t.Errorf("record %d: %+v, expected %+v", i, r, expected)
+		}
+	}
+}
+
+func TestSqliteScanRange(t *testing.T) {
+	b := openTestSqlite(t)
+	res := bme280.Result{Temperature: 20, Pressure: 1000}
+	if err := b.append(DefaultSensor, sqliteRecords(res, res, res, res)...); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		start, end time.Duration
+		count      int
+	}{
+		{"all", 0, 4 * time.Minute, 4},
+		{"end is exclusive", 0, 3 * time.Minute, 3},
+		{"start within a second", time.Minute + time.Millisecond, 4 * time.Minute, 2},
+		{"end within a second", 0, time.Minute + time.Millisecond, 2},
+		{"empty range", time.Minute, time.Minute, 0},
+		{"after the last record", time.Hour, 2 * time.Hour, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			read := scanAll(t, b, DefaultSensor, sqliteStart.Add(test.start), sqliteStart.Add(test.end))
+			if len(read) != test.count {
+				t.Errorf("%d records, expected %d", len(read), test.count)
+			}
+		})
+	}
+}
+
+func TestSqliteSensors(t *testing.T) {
+	b := openTestSqlite(t)
+	if first, err := b.first(DefaultSensor); err != nil || !first.IsZero() {
+		t.Errorf("first of an empty database %v, %v", first, err)
+	}
+	if last, err := b.last(DefaultSensor, 3); err != nil || len(last) != 0 {
+		t.Errorf("last of an empty database %v, %v", last, err)
+	}
+	indoor := bme280.Result{Temperature: 21, Pressure: 1000}
+	outdoor := bme280.Result{Temperature: 10, Pressure: 1000}
+	if err := b.append("indoor", sqliteRecords(indoor, indoor, indoor)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.append("outdoor", sqliteRecords(outdoor)...); err != nil {
+		t.Fatal(err)
+	}
+	if read := scanAll(t, b, "outdoor", time.Time{}, endOfTime); len(read) != 1 || read[0].res.Temperature != 10 {
+		t.Errorf("outdoor %+v", read)
+	}
+	if first, err := b.first("indoor"); err != nil || !first.Equal(sqliteStart) {
+		t.Errorf("first %v, %v", first, err)
+	}
+	last, err := b.last("indoor", 2)
+	if err != nil || len(last) != 2 || !last[1].t.Equal(sqliteStart.Add(2*time.Minute)) {
+		t.Errorf("last %+v, %v", last, err)
+	}
+
+	// a value of the same second replaces the stored one
+	replaced := sqliteRecords(bme280.Result{Temperature: 25, Pressure: 1000})
+	if err = b.append("indoor", replaced...); err != nil {
+		t.Fatal(err)
+	}
+	if read := scanAll(t, b, "indoor", time.Time{}, endOfTime); len(read) != 3 || read[0].res.Temperature != 25 {
+		t.Errorf("indoor after replace %+v", read)
+	}
+}
+
+func TestSqliteRemoveAndRewrite(t *testing.T) {
+	b := openTestSqlite(t)
+	res := bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 50, Channels: bme280.CHANNEL_HUMIDITY}
+	if err := b.append(DefaultSensor, sqliteRecords(res, res, res)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.removeBefore(DefaultSensor, sqliteStart.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := b.first(DefaultSensor); !first.Equal(sqliteStart.Add(time.Minute)) {
+		t.Errorf("first after remove %v", first)
+	}
+
+	err := b.rewrite(DefaultSensor, func(r record) record {
+		r.res.Temperature = r.raw.Temperature + 1
+		return r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := scanAll(t, b, DefaultSensor, time.Time{}, endOfTime)
+	if len(read) != 2 {
+		t.Fatalf("%d records after rewrite", len(read))
+	}
+	for _, r := range read {
+		if r.res.Temperature != 21.5 || r.raw.Temperature != 20.5 || r.res.Humidity != 50 {
+			t.Errorf("rewritten %+v", r)
+		}
+	}
+}
+
+func TestSqliteFsck(t *testing.T) {
+	b := openTestSqlite(t)
+	res := bme280.Result{Temperature: 20, Pressure: 1000, Humidity: 50, Channels: bme280.CHANNEL_HUMIDITY}
+	if err := b.append(DefaultSensor, sqliteRecords(res, res)...); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.db.Exec(`UPDATE readings SET value = 'garbage'
+		WHERE time = ? AND channel_id = ?`, sqliteStart.Unix(), int(HumidityPos))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report FsckReport
+	if err = b.fsck(DefaultSensor, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Lines != 2 || report.Malformed != 1 || report.Repaired != 1 {
+		t.Errorf("report %+v", report)
+	}
+	read := scanAll(t, b, DefaultSensor, time.Time{}, endOfTime)
+	if len(read) != 2 || read[0].res.HasHumidity() || !read[1].res.HasHumidity() {
+		t.Errorf("records after fsck %+v", read)
+	}
+}
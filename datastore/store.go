@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stored values of all sensors of a station. Values are appended by a
+// single writer while HTTP handlers query concurrently.
+type Store struct {
+	layout
+	backend backend
+	// Names of all configured sensors; the first one is shown by default
+	sensorNames []string
+
+	// Guards lastValues and pressureQueues
+	mu sync.RWMutex
+	// Per sensor four entries with the last values for temp(0), pressure(1), humidity(2)
+	// and gas resistance(3); entries of channels the sensor does not measure have no time
+	lastValues map[string][]Entry
+	// Per sensor last 30 pressure entries; used to determine the air pressure trend
+	pressureQueues map[string]*list.List
+
+	// Serialises appending to and rewriting of files; guards nextRollups
+	fileLock sync.Mutex
+	// Per sensor and rollup period the start of the next period to roll up
+	nextRollups map[string][]time.Time
+}
+
+// Store in directory dir with rotation ROTATION_DAY or ROTATION_MONTH and
+// values in format FORMAT_CSV, FORMAT_BINARY or FORMAT_SQLITE. Rotation and
+// rollup periods are in the time zone location.
+func NewStore(dir string, sensorNames []string, rotation string, format string, location *time.Location) (*Store, error) {
+	if rotation != ROTATION_DAY && rotation != ROTATION_MONTH {
+		return nil, fmt.Errorf("unknown rotation %q", rotation)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	if dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	l := layout{dir: dir, rotation: rotation, location: location}
+	b, err := newBackend(format, l)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Data directory set to %s", dir)
+	return &Store{
+		layout:         l,
+		backend:        b,
+		sensorNames:    sensorNames,
+		lastValues:     make(map[string][]Entry),
+		pressureQueues: make(map[string]*list.List),
+		nextRollups:    make(map[string][]time.Time),
+	}, nil
+}
+
+func (s *Store) GetSensorNames() []string {
+	return s.sensorNames
+}
+
+func (s *Store) IsSensorName(name string) bool {
+	for _, n := range s.sensorNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
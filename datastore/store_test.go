@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	code := m.Run()
+	if benchDir != "" {
+		os.RemoveAll(benchDir)
+	}
+	os.Exit(code)
+}
+
+func testResult(i int) bme280.Result {
+	return bme280.Result{
+		Temperature: 10 + float32(i%200)/10,
+		Pressure:    1000 + float32(i%50)/10,
+		Humidity:    40 + float32(i%300)/10,
+		Channels:    bme280.CHANNEL_HUMIDITY,
+	}
+}
+
+// Append n values with the given step starting at start
+func appendTestValues(tb testing.TB, s *Store, start time.Time, n int, step time.Duration) {
+	const batchSize = 10000
+	batch := make([]record, 0, batchSize)
+	for i := 0; i < n; i++ {
+		res := testResult(i)
+		batch = append(batch, record{t: start.Add(time.Duration(i) * step), res: res, raw: res})
+		if len(batch) == batchSize || i == n-1 {
+			if err := s.backend.append(DefaultSensor, batch...); err != nil {
+				tb.Fatal(err)
+			}
+			batch = batch[:0]
+		}
+	}
+}
+
+// Data directories of benchmarks; created once, as they are large
+var (
+	benchDir    string
+	benchStores = make(map[string]*Store)
+)
+
+const benchStep = 5 * time.Minute
+
+// End of the stored values of benchmarks
+var benchEnd = time.Date(2021, 9, 1, 0, 0, 0, 0, time.Local)
+
+// Store with values every 5 minutes for the given months before benchEnd
+func benchStore(b *testing.B, format string, months int) *Store {
+	key := format + "/" + strconv.Itoa(months)
+	if s, ok := benchStores[key]; ok {
+		return s
+	}
+	if benchDir == "" {
+		dir, err := ioutil.TempDir("", "datastore")
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchDir = dir
+	}
+	dir := filepath.Join(benchDir, format, strconv.Itoa(months))
+	s, err := NewStore(dir, []string{DefaultSensor}, ROTATION_MONTH, format, time.Local)
+	if err != nil {
+		b.Fatal(err)
+	}
+	start := benchEnd.AddDate(0, -months, 0)
+	appendTestValues(b, s, start, int(benchEnd.Sub(start)/benchStep), benchStep)
+	benchStores[key] = s
+	return s
+}
+
+// One writer and several readers; run with -race
+func TestStoreConcurrentAccess(t *testing.T) {
+	for _, format := range []string{FORMAT_CSV, FORMAT_BINARY, FORMAT_SQLITE} {
+		t.Run(format, func(t *testing.T) {
+			s, err := NewStore(t.TempDir(), []string{DefaultSensor}, ROTATION_DAY, format, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if closer, ok := s.backend.(io.Closer); ok {
+				defer closer.Close()
+			}
+			const writes = 50
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(done)
+				for i := 0; i < writes; i++ {
+					res := testResult(i)
+					s.AppendToStore(DefaultSensor, res, res)
+				}
+			}()
+			q := SeriesQuery{
+				Sensor:      DefaultSensor,
+				Channels:    []CsvPos{TemperaturePos, PressurePos, HumidityPos},
+				Start:       time.Now().Add(-time.Hour),
+				End:         time.Now().Add(time.Hour),
+				Aggregation: AGGREGATION_AVG,
+			}
+			for r := 0; r < 4; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if values := s.GetLastValues(DefaultSensor); len(values) != 4 {
+							t.Errorf("%d last values", len(values))
+						}
+						s.GetPressureTrend(DefaultSensor)
+						if _, err := s.QuerySeries(q); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if last := s.GetLastValues(DefaultSensor); last[0].Value != testResult(writes-1).Temperature {
+				t.Errorf("last temperature %v, expected %v", last[0].Value, testResult(writes-1).Temperature)
+			}
+			stored := 0
+			err = s.backend.scan(DefaultSensor, q.Start, q.End, func(r record) error {
+				stored++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// values of the same second replace each other in sqlite
+			if format == FORMAT_SQLITE {
+				if stored == 0 || stored > writes {
+					t.Errorf("%d stored values, expected 1 to %d", stored, writes)
+				}
+			} else if stored != writes {
+				t.Errorf("%d stored values, expected %d", stored, writes)
+			}
+		})
+	}
+}
+
+// Only values within the trend window are restored into the pressure queue
+func TestRestoreLastValues(t *testing.T) {
+	tests := []struct {
+		name string
+		// age of the last stored value
+		age   time.Duration
+		trend string
+	}{
+		{"recent values", time.Minute, "up"},
+		{"after a downtime", 2 * time.Hour, ""},
+		{"after a short downtime", 20 * time.Minute, "up"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewStore(t.TempDir(), []string{DefaultSensor}, ROTATION_DAY, FORMAT_CSV, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// rising pressure every minute
+			end := time.Now().Add(-test.age)
+			for i := 0; i < pressureQueueMaxLength; i++ {
+				res := testResult(0)
+				res.Pressure = 1000 + float32(i)
+				r := record{t: end.Add(time.Duration(i-pressureQueueMaxLength+1) * time.Minute), res: res, raw: res}
+				if err = s.backend.append(DefaultSensor, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.RestoreLastValues()
+			if last := s.GetLastValues(DefaultSensor); last[1].Value != 1000+pressureQueueMaxLength-1 {
+				t.Errorf("last pressure %v", last[1].Value)
+			}
+			if trend := s.GetPressureTrend(DefaultSensor); trend != test.trend {
+				t.Errorf("trend %q, expected %q", trend, test.trend)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package bosch
+
+/**
+ * Register helpers shared by the drivers of the Bosch Sensortec
+ * BME280 / BMP280 and BME680 sensors
+**/
+
+// Register values for oversampling settings (osrs_t, osrs_p, osrs_h)
+var OversamplingBits = map[int]byte{0: 0, 1: 1, 2: 2, 4: 3, 8: 4, 16: 5}
+
+// Register values for the IIR filter coefficient. The BME680 datasheet
+// names the filter sizes 1, 3, 7 and 15 instead, i.e. the coefficient - 1.
+var FilterBits = map[int]byte{0: 0, 2: 1, 4: 2, 8: 3, 16: 4}
+
+// unsigned int from two bytes (little-endian)
+func Uint16LE(b0 byte, b1 byte) uint16 {
+	return uint16(b1)<<8 | uint16(b0)
+}
+
+// signed int from two bytes (little-endian)
+func Int16LE(b0 byte, b1 byte) int16 {
+	return int16(b1)<<8 | int16(b0)
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/tquellenberg/weatherstation/bme280"
+	"github.com/tquellenberg/weatherstation/calibration"
 	"github.com/tquellenberg/weatherstation/chart"
 	"github.com/tquellenberg/weatherstation/datastore"
 	"github.com/tquellenberg/weatherstation/opensensemap"
+	"github.com/tquellenberg/weatherstation/sensor"
 	"github.com/tquellenberg/weatherstation/sun"
 	"gopkg.in/yaml.v3"
 
@@ -26,19 +30,64 @@ type Config struct {
 		Longitude float64
 	}
 	OpensenseMap struct {
+		// Name of the sensor whose values are sent; the first sensor by default
+		Sensor     string `yaml:"sensor"`
 		BoxId      string `yaml:"boxId"`
 		TempSensor string `yaml:"tempSensor"`
 		PresSensor string `yaml:"presSensor"`
 		HumiSensor string `yaml:"humiSensor"`
 	} `yaml:"opensenseMap"`
+	// "bme280" (default) or "simulated"
+	Sensor string
 	Bme280 struct {
-		I2cAddress int
+		bme280.TransportConfig `yaml:",inline"`
+		bme280.Configuration   `yaml:",inline"`
 	}
 	Http struct {
 		Port int
+		// Time zone of charts, API, data file rotation and rollups, e.g.
+		// "Europe/Berlin"; the system time zone by default
+		Timezone string
 	}
+	Recovery     sensor.RecoveryPolicy
+	Plausibility sensor.PlausibilityConfig
+	Calibration  calibration.Config
+	// Several named sensors; if empty the single sensor above is used
+	Sensors []SensorConfig
+	// Keep raw ADC values and t_fine of every reading in a separate file
+	StoreAdcValues bool `yaml:"storeAdcValues"`
+	Storage        struct {
+		// "csv" (default), "binary" or "sqlite"
+		Format string
+		// "month" (default) or "day"; binary values are stored per day
+		Rotation  string
+		Retention datastore.RetentionPolicy
+	}
+}
+
+type SensorConfig struct {
+	Name string
+	// "bme280" (default; also detects BMP280 and BME680) or "simulated"
+	Type                   string
+	bme280.TransportConfig `yaml:",inline"`
+	bme280.Configuration   `yaml:",inline"`
+	Calibration            calibration.Config
+}
+
+// Fill unset values of a sensor entry with the defaults
+func (c *SensorConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain SensorConfig
+	p := plain{Configuration: bme280.DefaultConfiguration()}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*c = SensorConfig(p)
+	return nil
 }
 
+// Only letters, digits, '-' and '_'; the name is part of file names and URLs
+var validSensorName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // The I2C address which this device listens to.
 const DEFAULT_I2C_ADDRESS = 0x76
 
@@ -54,6 +103,8 @@ func initHttp(port int) {
 	r.HandleFunc("/temperatureData", chart.TempData).Methods(http.MethodGet)
 	r.HandleFunc("/pressureData", chart.PressureData).Methods(http.MethodGet)
 	r.HandleFunc("/humidityData", chart.HumidityData).Methods(http.MethodGet)
+	r.HandleFunc("/gasData", chart.GasData).Methods(http.MethodGet)
+	r.HandleFunc("/seriesData", chart.SeriesData).Methods(http.MethodGet)
 	r.HandleFunc("/timecharts", chart.TimeCharts).Methods(http.MethodGet)
 
 	// Index Overview
@@ -74,13 +125,79 @@ func setDefault(config *Config) {
 	if config.Http.Port == 0 {
 		config.Http.Port = DEFAULT_HTTP_PORT
 	}
-	if config.Bme280.I2cAddress == 0 {
-		config.Bme280.I2cAddress = DEFAULT_I2C_ADDRESS
+	if len(config.Sensors) == 0 {
+		config.Sensors = []SensorConfig{{
+			Name:            datastore.DefaultSensor,
+			Type:            config.Sensor,
+			TransportConfig: config.Bme280.TransportConfig,
+			Configuration:   config.Bme280.Configuration,
+			Calibration:     config.Calibration,
+		}}
+	}
+	for i := range config.Sensors {
+		if config.Sensors[i].Type == "" {
+			config.Sensors[i].Type = sensor.TYPE_BME280
+		}
+		if config.Sensors[i].I2cAddress == 0 {
+			config.Sensors[i].I2cAddress = DEFAULT_I2C_ADDRESS
+		}
+	}
+	if config.OpensenseMap.Sensor == "" {
+		config.OpensenseMap.Sensor = config.Sensors[0].Name
+	}
+	if config.Storage.Format == "" {
+		config.Storage.Format = datastore.FORMAT_CSV
+	}
+	if config.Storage.Rotation == "" {
+		config.Storage.Rotation = datastore.ROTATION_MONTH
 	}
 }
 
-func readConfig() Config {
+func validateConfig(config *Config) error {
+	names := make(map[string]bool)
+	for _, s := range config.Sensors {
+		if !validSensorName.MatchString(s.Name) {
+			return fmt.Errorf("invalid sensor name %q", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate sensor name %q", s.Name)
+		}
+		names[s.Name] = true
+		if err := s.TransportConfig.Validate(); err != nil {
+			return fmt.Errorf("sensor %s: %v", s.Name, err)
+		}
+		if err := s.Configuration.Validate(); err != nil {
+			return fmt.Errorf("sensor %s: %v", s.Name, err)
+		}
+		if err := s.Calibration.Validate(); err != nil {
+			return fmt.Errorf("sensor %s: calibration: %v", s.Name, err)
+		}
+	}
+	if err := config.Storage.Retention.Validate(); err != nil {
+		return fmt.Errorf("storage: %v", err)
+	}
+	return nil
+}
+
+func sensorNames(config *Config) []string {
+	names := make([]string, 0, len(config.Sensors))
+	for _, s := range config.Sensors {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// Settings which are not in weatherstation.yml
+func defaultConfig() Config {
 	config := Config{}
+	config.Bme280.Configuration = bme280.DefaultConfiguration()
+	config.Recovery = sensor.DefaultRecoveryPolicy()
+	config.Plausibility = sensor.DefaultPlausibilityConfig()
+	return config
+}
+
+func readConfig() Config {
+	config := defaultConfig()
 
 	b, err := ioutil.ReadFile("weatherstation.yml")
 	if err != nil {
@@ -100,20 +217,250 @@ func sendOpensensemapData(opensensemapToken *string, v bme280.Result, config *Co
 		config.OpensenseMap.BoxId, config.OpensenseMap.TempSensor)
 	opensensemap.PostFloatValue(*opensensemapToken, v.Pressure, 1,
 		config.OpensenseMap.BoxId, config.OpensenseMap.PresSensor)
-	opensensemap.PostFloatValue(*opensensemapToken, v.Humidity, 1,
-		config.OpensenseMap.BoxId, config.OpensenseMap.HumiSensor)
+	if v.HasHumidity() {
+		opensensemap.PostFloatValue(*opensensemapToken, v.Humidity, 1,
+			config.OpensenseMap.BoxId, config.OpensenseMap.HumiSensor)
+	}
+}
+
+// Distinct I2C buses of the configured sensors; the first available bus
+// if no sensor uses I2C
+func i2cBuses(config *Config) []string {
+	buses := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, s := range config.Sensors {
+		if s.Transport != "" && s.Transport != bme280.TRANSPORT_I2C {
+			continue
+		}
+		if !seen[s.I2cBus] {
+			seen[s.I2cBus] = true
+			buses = append(buses, s.I2cBus)
+		}
+	}
+	if len(buses) == 0 {
+		buses = append(buses, "")
+	}
+	return buses
+}
+
+func scanI2cBus(bus string) {
+	devices, err := bme280.Scan(bus)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Println("No devices found")
+	}
+	for _, d := range devices {
+		if d.ChipName != "" {
+			fmt.Printf("%#x: %s\n", d.Address, d.ChipName)
+		} else {
+			fmt.Printf("%#x: unsupported device (chip id %#x)\n", d.Address, d.ChipId)
+		}
+	}
+}
+
+// Registers of the sensor with the given name; the first sensor without a name
+func dumpRegisters(config *Config, name string, filename string) error {
+	var c *SensorConfig
+	if name == "" {
+		c = &config.Sensors[0]
+	}
+	for i := range config.Sensors {
+		if config.Sensors[i].Name == name {
+			c = &config.Sensors[i]
+		}
+	}
+	if c == nil {
+		return fmt.Errorf("unknown sensor %q in -dumpSensor", name)
+	}
+	t, err := c.TransportConfig.Open()
+	if err != nil {
+		return err
+	}
+	d, err := bme280.InitBme280(t)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.SetConfiguration(c.Configuration); err != nil {
+		return err
+	}
+	dump, err := d.Dump()
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing registers of sensor %s to %s", c.Name, filename)
+	return dump.WriteFile(filename)
+}
+
+// One sensor of the station with its processing chain
+type station struct {
+	name        string
+	sensor      sensor.Sensor
+	recovery    *sensor.RecoveringSensor
+	calibration calibration.Config
+	store       *datastore.Store
+}
+
+func initStation(c SensorConfig, config *Config, store *datastore.Store) (*station, error) {
+	d, err := sensor.NewSensor(c.Type, c.TransportConfig, c.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	// spikes are rejected before the recovery, so they count as failures
+	p := sensor.NewPlausibilityFilter(d, config.Plausibility)
+	r := sensor.NewRecoveringSensor(p, config.Recovery)
+	r.OnRecovery = func(err error) {
+		CountRecovery(c.Name, err)
+	}
+	// the recovery initialises the sensor again after failed reads
+	if err = r.Init(); err != nil {
+		log.Printf("Sensor %s: Init failed: %v", c.Name, err)
+	}
+	return &station{name: c.Name, sensor: r, recovery: r, calibration: c.Calibration, store: store}, nil
+}
+
+func (s *station) readAndStore(opensensemapToken *string, config *Config) {
+	reading, err := s.sensor.Read()
+	UpdateSensorHealthMetrics(s.name, s.recovery.Failures())
+	raw := reading.Result
+	var v bme280.Result
+	if err == nil {
+		v, err = s.calibration.Apply(raw)
+	}
+	var invalidValue *bme280.InvalidValueError
+	if bme280.IsDeviceError(err) {
+		log.Printf("Sensor %s not readable: %v", s.name, err)
+	} else if errors.As(err, &invalidValue) {
+		log.Printf("Sensor %s: Skip invalid values: %v", s.name, err)
+		CountRejected(s.name, invalidValue.Channel)
+	} else if err != nil {
+		log.Printf("Sensor %s: Skip invalid values %v", s.name, err)
+	} else {
+		fmt.Printf("Sensor: %s\n", s.name)
+		fmt.Printf("Temp: %3.2f Grad C\n", v.Temperature)
+		fmt.Printf("Pres: %4.2f hPa\n", v.Pressure)
+		if v.HasHumidity() {
+			fmt.Printf("Humi: %3.2f %%\n", v.Humidity)
+		}
+		if v.HasGasResistance() {
+			fmt.Printf("Gas:  %.0f Ohm\n", v.GasResistance)
+		}
+
+		s.store.AppendToStore(s.name, v, raw)
+		if config.StoreAdcValues {
+			s.store.AppendAdcToStore(s.name, reading)
+		}
+
+		UpdateMetrics(s.name, v)
+
+		if *opensensemapToken != "" && s.name == config.OpensenseMap.Sensor {
+			go sendOpensensemapData(opensensemapToken, v, config)
+		}
+	}
 }
 
 func main() {
 	noDataReading := flag.Bool("noDataReading", false, "do not read new values")
 	dataDir := flag.String("dataDir", "./data", "directory for storing data files")
 	opensensemapToken := flag.String("opensensemapToken", "", "API token for opensensemap")
+	sensorType := flag.String("sensor", "", "sensor type (bme280 or simulated) for all sensors; overrides weatherstation.yml")
+	recalibrate := flag.Bool("recalibrate", false, "apply the current calibration to all stored raw values and exit")
+	fsck := flag.Bool("fsck", false, "check and repair the stored files and exit")
+	convertTo := flag.String("convertTo", "", "convert the stored values to this format (csv, binary or sqlite) and exit")
+	rebuildRollups := flag.Bool("rebuildRollups", false, "recalculate the hourly and daily rollups from the stored values and exit")
+	scan := flag.Bool("scan", false, "scan the I2C buses of the configured sensors for supported sensors and exit")
+	scanBus := flag.String("scanBus", "", "I2C bus for -scan instead of the configured buses")
+	dumpFile := flag.String("dump", "", "write the registers of a BME280/BMP280 to this file and exit")
+	dumpSensor := flag.String("dumpSensor", "", "name of the sensor for -dump; the first sensor by default")
 	flag.Parse()
 
 	config := readConfig()
 	setDefault(&config)
+	// before the validation, as scanning helps to fix the configuration
+	if *scan {
+		buses := i2cBuses(&config)
+		if *scanBus != "" {
+			buses = []string{*scanBus}
+		}
+		for _, bus := range buses {
+			scanI2cBus(bus)
+		}
+		return
+	}
+	if *sensorType != "" {
+		for i := range config.Sensors {
+			config.Sensors[i].Type = *sensorType
+		}
+	}
+	if err := validateConfig(&config); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return
+	}
+
+	if *dumpFile != "" {
+		if err := dumpRegisters(&config, *dumpSensor, *dumpFile); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	location := time.Local
+	if config.Http.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(config.Http.Timezone)
+		if err != nil {
+			log.Printf("Invalid configuration: %v", err)
+			return
+		}
+	}
+	chart.SetLocation(location)
+
+	store, err := datastore.NewStore(*dataDir, sensorNames(&config), config.Storage.Rotation, config.Storage.Format, location)
+	if err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return
+	}
+	if *fsck {
+		report, err := store.Fsck()
+		if err != nil {
+			log.Println(err)
+		}
+		log.Printf("Checked %d files with %d lines: %d malformed lines, %d unordered files, %d files repaired",
+			report.Files, report.Lines, report.Malformed, report.Unordered, report.Repaired)
+		return
+	}
+	store.MigrateLegacyFiles()
+
+	if *convertTo != "" {
+		if err := store.ConvertTo(*convertTo); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if *recalibrate {
+		for _, s := range config.Sensors {
+			if err := store.Recalibrate(s.Name, s.Calibration.Apply); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	if *rebuildRollups {
+		for _, s := range config.Sensors {
+			if err := store.RebuildRollups(s.Name); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
 
-	datastore.SetDataDir(*dataDir)
+	store.RestoreLastValues()
+	store.StartRetention(config.Storage.Retention)
+	chart.SetStore(store)
 
 	initHttp(config.Http.Port)
 
@@ -126,30 +473,20 @@ func main() {
 		// wait forever
 		select {}
 	} else {
-		d, err := bme280.InitBme280(config.Bme280.I2cAddress)
-		if err != nil {
-			log.Println(err)
-			return
+		stations := make([]*station, 0, len(config.Sensors))
+		for _, c := range config.Sensors {
+			s, err := initStation(c, &config, store)
+			if err != nil {
+				log.Printf("Sensor %s: %v", c.Name, err)
+				return
+			}
+			stations = append(stations, s)
 		}
 		time.Sleep(time.Second)
 
 		for {
-			d.SetConfiguration()
-			v, err := d.ReadValues()
-			if err != nil {
-				log.Printf("Skip invalid values %v", err)
-			} else {
-				fmt.Printf("Temp: %3.2f Grad C\n", v.Temperature)
-				fmt.Printf("Pres: %4.2f hPa\n", v.Pressure)
-				fmt.Printf("Humi: %3.2f %%\n", v.Humidity)
-
-				datastore.AppendToStore(v)
-
-				UpdateMetrics(v)
-
-				if *opensensemapToken != "" {
-					go sendOpensensemapData(opensensemapToken, v, &config)
-				}
+			for _, s := range stations {
+				s.readAndStore(opensensemapToken, &config)
 			}
 			time.Sleep(time.Minute)
 		}
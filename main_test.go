@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tquellenberg/weatherstation/datastore"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration from YAML with the defaults of readConfig and setDefault
+func parseConfig(t *testing.T, text string) Config {
+	t.Helper()
+	config := defaultConfig()
+	if err := yaml.Unmarshal([]byte(text), &config); err != nil {
+		t.Fatal(err)
+	}
+	setDefault(&config)
+	return config
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// part of the expected error; "" for a valid configuration
+		err string
+	}{
+		{"single sensor", "bme280:\n  i2cbus: \"1\"\n", ""},
+		{"sensors", "sensors:\n  - name: indoor\n  - name: outdoor\n    i2caddress: 0x77\n", ""},
+		{"duplicate sensor names", "sensors:\n  - name: indoor\n  - name: indoor\n    i2caddress: 0x77\n", "duplicate sensor name"},
+		{"invalid sensor name", "sensors:\n  - name: in door\n", "invalid sensor name"},
+		{"empty sensor name", "sensors:\n  - i2caddress: 0x77\n", "invalid sensor name"},
+		{"unknown transport", "sensors:\n  - name: indoor\n    transport: usb\n", "invalid transport"},
+		{"replay without file", "sensors:\n  - name: indoor\n    transport: replay\n", "replayFile"},
+		{"invalid oversampling", "sensors:\n  - name: indoor\n    oversamplingPressure: 3\n", "sensor indoor: invalid pressure oversampling"},
+		{"invalid filter of the single sensor", "bme280:\n  filter: 5\n", "invalid filter"},
+		{"invalid calibration", "sensors:\n  - name: indoor\n    calibration:\n      humidity:\n        points:\n          - measured: 10\n", "calibration: humidity"},
+		{"negative retention", "storage:\n  retention:\n    rawDays: -1\n", "storage"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := parseConfig(t, test.yaml)
+			err := validateConfig(&config)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	config := parseConfig(t, "sensors:\n  - name: indoor\n    filter: 4\n  - name: outdoor\n    i2caddress: 0x77\n")
+	if len(config.Sensors) != 2 {
+		t.Fatalf("%d sensors", len(config.Sensors))
+	}
+	indoor, outdoor := config.Sensors[0], config.Sensors[1]
+	if indoor.I2cAddress != DEFAULT_I2C_ADDRESS || outdoor.I2cAddress != 0x77 {
+		t.Errorf("addresses %#x and %#x", indoor.I2cAddress, outdoor.I2cAddress)
+	}
+	// unset settings of a sensor entry are the defaults
+	if indoor.Filter != 4 || indoor.OversamplingTemperature != 1 || outdoor.Mode != "forced" {
+		t.Errorf("configuration %+v and %+v", indoor.Configuration, outdoor.Configuration)
+	}
+	if config.OpensenseMap.Sensor != "indoor" || config.Storage.Format != datastore.FORMAT_CSV || config.Http.Port != DEFAULT_HTTP_PORT {
+		t.Errorf("defaults %+v", config)
+	}
+
+	single := parseConfig(t, "sensor: simulated\n")
+	if len(single.Sensors) != 1 || single.Sensors[0].Name != datastore.DefaultSensor || single.Sensors[0].Type != "simulated" {
+		t.Errorf("single sensor %+v", single.Sensors)
+	}
+}
+
+func TestI2cBuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected []string
+	}{
+		{"single sensor", "bme280:\n  i2cbus: \"1\"\n", []string{"1"}},
+		{"first available bus", "", []string{""}},
+		{"same bus", "sensors:\n  - name: indoor\n    i2cbus: \"1\"\n  - name: outdoor\n    i2cbus: \"1\"\n    i2caddress: 0x77\n", []string{"1"}},
+		{"two buses", "sensors:\n  - name: indoor\n    i2cbus: \"1\"\n  - name: outdoor\n    transport: i2c\n    i2cbus: \"3\"\n", []string{"1", "3"}},
+		{"spi sensor", "sensors:\n  - name: indoor\n    transport: spi\n  - name: outdoor\n    i2cbus: \"3\"\n", []string{"3"}},
+		{"only spi sensors", "sensors:\n  - name: indoor\n    transport: spi\n    i2cbus: \"1\"\n", []string{""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := parseConfig(t, test.yaml)
+			if buses := i2cBuses(&config); strings.Join(buses, "|") != strings.Join(test.expected, "|") || len(buses) != len(test.expected) {
+				t.Errorf("%q, expected %q", buses, test.expected)
+			}
+		})
+	}
+}
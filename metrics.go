@@ -6,31 +6,95 @@ import (
 )
 
 var (
-	tempGauge = prometheus.NewGauge(
+	tempGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "tomsweather",
 			Name:      "temperature",
-			Help:      "Temperature in degrees Celsius"})
-	pressureGauge = prometheus.NewGauge(
+			Help:      "Temperature in degrees Celsius"},
+		[]string{"sensor"})
+	pressureGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "tomsweather",
 			Name:      "pressure",
-			Help:      "Air pressure in hectopascal"})
-	humidityGauge = prometheus.NewGauge(
+			Help:      "Air pressure in hectopascal"},
+		[]string{"sensor"})
+	humidityGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "tomsweather",
 			Name:      "humidity",
-			Help:      "Humidity in percent"})
+			Help:      "Humidity in percent"},
+		[]string{"sensor"})
+	gasGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "tomsweather",
+			Name:      "gas_resistance",
+			Help:      "Gas resistance in ohm"},
+		[]string{"sensor"})
+	sensorHealthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "tomsweather",
+			Name:      "sensor_healthy",
+			Help:      "1 if the last sensor read was successful, otherwise 0"},
+		[]string{"sensor"})
+	sensorFailuresGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "tomsweather",
+			Name:      "sensor_consecutive_failures",
+			Help:      "Number of consecutive failed sensor reads"},
+		[]string{"sensor"})
+	recoveryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tomsweather",
+			Name:      "sensor_recovery_attempts_total",
+			Help:      "Number of sensor re-initialisations by result"},
+		[]string{"sensor", "result"})
+	rejectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tomsweather",
+			Name:      "rejected_readings_total",
+			Help:      "Number of implausible readings which were not stored"},
+		[]string{"sensor", "channel"})
 )
 
 func InitMetrics() {
 	prometheus.MustRegister(tempGauge)
 	prometheus.MustRegister(pressureGauge)
 	prometheus.MustRegister(humidityGauge)
+	prometheus.MustRegister(gasGauge)
+	prometheus.MustRegister(sensorHealthGauge)
+	prometheus.MustRegister(sensorFailuresGauge)
+	prometheus.MustRegister(recoveryCounter)
+	prometheus.MustRegister(rejectedCounter)
+}
+
+func UpdateMetrics(sensor string, v bme280.Result) {
+	tempGauge.WithLabelValues(sensor).Set(float64(v.Temperature))
+	pressureGauge.WithLabelValues(sensor).Set(float64(v.Pressure))
+	if v.HasHumidity() {
+		humidityGauge.WithLabelValues(sensor).Set(float64(v.Humidity))
+	}
+	if v.HasGasResistance() {
+		gasGauge.WithLabelValues(sensor).Set(float64(v.GasResistance))
+	}
+}
+
+func UpdateSensorHealthMetrics(sensor string, consecutiveFailures int) {
+	if consecutiveFailures == 0 {
+		sensorHealthGauge.WithLabelValues(sensor).Set(1)
+	} else {
+		sensorHealthGauge.WithLabelValues(sensor).Set(0)
+	}
+	sensorFailuresGauge.WithLabelValues(sensor).Set(float64(consecutiveFailures))
+}
+
+func CountRecovery(sensor string, err error) {
+	if err != nil {
+		recoveryCounter.WithLabelValues(sensor, "failure").Inc()
+	} else {
+		recoveryCounter.WithLabelValues(sensor, "success").Inc()
+	}
 }
 
-func UpdateMetrics(v bme280.Result) {
-	tempGauge.Set(float64(v.Temperature))
-	pressureGauge.Set(float64(v.Pressure))
-	humidityGauge.Set(float64(v.Humidity))
+func CountRejected(sensor string, channel string) {
+	rejectedCounter.WithLabelValues(sensor, channel).Inc()
 }
@@ -0,0 +1,63 @@
+package sensor
+
+import (
+	"github.com/tquellenberg/weatherstation/bme280"
+	"github.com/tquellenberg/weatherstation/bme680"
+)
+
+// Driver of one of the supported Bosch chips
+type device interface {
+	SetConfiguration(c bme280.Configuration) error
+	ReadReading() (bme280.Reading, error)
+	Close() error
+}
+
+// Sensor backed by a BME280, BMP280 or BME680 chip on the I2C or SPI bus;
+// the chip is detected by its id
+type Bme280Sensor struct {
+	Transport     bme280.TransportConfig
+	Configuration bme280.Configuration
+	dev           device
+}
+
+func (s *Bme280Sensor) Init() error {
+	t, err := s.Transport.Open()
+	if err != nil {
+		return err
+	}
+	chipId, err := bme280.ReadChipId(t)
+	if err != nil {
+		t.Close()
+		return err
+	}
+	var d device
+	if chipId == bme280.CHIP_ID_BME680 {
+		d, err = bme680.InitBme680(t)
+	} else {
+		d, err = bme280.InitBme280(t)
+	}
+	if err != nil {
+		return err
+	}
+	s.dev = d
+	return d.SetConfiguration(s.Configuration)
+}
+
+func (s *Bme280Sensor) Read() (bme280.Reading, error) {
+	if s.dev == nil {
+		return bme280.Reading{}, bme280.ErrNotInitialized
+	}
+	if err := s.dev.SetConfiguration(s.Configuration); err != nil {
+		return bme280.Reading{}, err
+	}
+	return s.dev.ReadReading()
+}
+
+func (s *Bme280Sensor) Close() error {
+	if s.dev == nil {
+		return nil
+	}
+	err := s.dev.Close()
+	s.dev = nil
+	return err
+}
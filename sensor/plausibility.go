@@ -0,0 +1,104 @@
+package sensor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+type PlausibilityConfig struct {
+	// Largest accepted change between two consecutive readings
+	MaxTemperatureJump float32 `yaml:"maxTemperatureJump"`
+	MaxPressureJump    float32 `yaml:"maxPressureJump"`
+	MaxHumidityJump    float32 `yaml:"maxHumidityJump"`
+	// Readings older than this are not used for comparison
+	MaxAge time.Duration `yaml:"maxAge"`
+	// After this many rejected readings in a row the new level is accepted
+	MaxRejections int `yaml:"maxRejections"`
+}
+
+func DefaultPlausibilityConfig() PlausibilityConfig {
+	return PlausibilityConfig{
+		MaxTemperatureJump: 3.0,
+		MaxPressureJump:    3.0,
+		MaxHumidityJump:    15.0,
+		MaxAge:             10 * time.Minute,
+		MaxRejections:      5,
+	}
+}
+
+// Wraps a sensor and rejects readings which jump implausibly
+// compared with the previous accepted reading
+type PlausibilityFilter struct {
+	Sensor Sensor
+	Config PlausibilityConfig
+
+	previous     *bme280.Result
+	previousTime time.Time
+	rejections   int
+}
+
+func NewPlausibilityFilter(s Sensor, config PlausibilityConfig) *PlausibilityFilter {
+	return &PlausibilityFilter{Sensor: s, Config: config}
+}
+
+func (f *PlausibilityFilter) Init() error {
+	f.previous = nil
+	return f.Sensor.Init()
+}
+
+func (f *PlausibilityFilter) Read() (bme280.Reading, error) {
+	reading, err := f.Sensor.Read()
+	if err != nil {
+		return reading, err
+	}
+	v := reading.Result
+	now := time.Now()
+	if f.previous != nil && now.Sub(f.previousTime) <= f.Config.MaxAge && f.rejections < f.Config.MaxRejections {
+		if err := f.spikeCheck(v); err != nil {
+			f.rejections++
+			return reading, err
+		}
+	}
+	f.previous = &v
+	f.previousTime = now
+	f.rejections = 0
+	return reading, nil
+}
+
+func (f *PlausibilityFilter) Close() error {
+	return f.Sensor.Close()
+}
+
+func (f *PlausibilityFilter) spikeCheck(v bme280.Result) error {
+	if err := jumpCheck("temperature", v.Temperature, f.previous.Temperature, f.Config.MaxTemperatureJump); err != nil {
+		return err
+	}
+	if err := jumpCheck("pressure", v.Pressure, f.previous.Pressure, f.Config.MaxPressureJump); err != nil {
+		return err
+	}
+	if v.HasHumidity() && f.previous.HasHumidity() {
+		if err := jumpCheck("humidity", v.Humidity, f.previous.Humidity, f.Config.MaxHumidityJump); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jumpCheck(channel string, value float32, previous float32, maxJump float32) error {
+	if maxJump <= 0 {
+		return nil
+	}
+	diff := value - previous
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > maxJump {
+		return &bme280.InvalidValueError{
+			Channel: channel,
+			Value:   value,
+			Reason:  fmt.Sprintf("jump of %0.2f from previous value %0.2f", diff, previous)}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package sensor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+func result(temperature, pressure float32) bme280.Result {
+	return bme280.Result{Temperature: temperature, Pressure: pressure}
+}
+
+func withHumidity(r bme280.Result, humidity float32) bme280.Result {
+	r.Humidity = humidity
+	r.Channels |= bme280.CHANNEL_HUMIDITY
+	return r
+}
+
+// Channel of the rejected value of each read; "" for accepted reads
+func readAll(t *testing.T, f *PlausibilityFilter, n int) []string {
+	t.Helper()
+	rejected := make([]string, n)
+	for i := range rejected {
+		_, err := f.Read()
+		var invalidValue *bme280.InvalidValueError
+		if errors.As(err, &invalidValue) {
+			rejected[i] = invalidValue.Channel
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rejected
+}
+
+func TestPlausibilityFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []bme280.Result
+		rejected []string
+	}{
+		{
+			name:     "small changes",
+			results:  []bme280.Result{result(20, 1000), result(22, 1002), result(24.9, 999.5)},
+			rejected: []string{"", "", ""},
+		},
+		{
+			name:     "temperature spike",
+			results:  []bme280.Result{result(20, 1000), result(35, 1000), result(20.5, 1000)},
+			rejected: []string{"", "temperature", ""},
+		},
+		{
+			name:     "pressure spike",
+			results:  []bme280.Result{result(20, 1000), result(20, 900), result(20, 1001)},
+			rejected: []string{"", "pressure", ""},
+		},
+		{
+			// a rejected reading is no reference for the next one
+			name:     "two spikes in a row",
+			results:  []bme280.Result{result(20, 1000), result(30, 1000), result(30, 1000), result(21, 1000)},
+			rejected: []string{"", "temperature", "temperature", ""},
+		},
+		{
+			name: "humidity spike",
+			results: []bme280.Result{withHumidity(result(20, 1000), 50), withHumidity(result(20, 1000), 90),
+				withHumidity(result(20, 1000), 55)},
+			rejected: []string{"", "humidity", ""},
+		},
+		{
+			// e.g. after the sensor was switched from a BMP280 to a BME280
+			name:     "humidity without previous humidity",
+			results:  []bme280.Result{result(20, 1000), withHumidity(result(20, 1000), 90)},
+			rejected: []string{"", ""},
+		},
+		{
+			// the first reading is accepted as reference; the correct level
+			// is accepted after the maximum number of rejections
+			name: "spike on the first sample",
+			results: []bme280.Result{result(85, 1000), result(20, 1000), result(20, 1000), result(20, 1000),
+				result(20, 1000), result(20, 1000), result(20, 1000), result(20.5, 1000)},
+			rejected: []string{"", "temperature", "temperature", "temperature", "temperature", "temperature", "", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &fakeSensor{}
+			for _, r := range test.results {
+				s.queue(r, nil)
+			}
+			f := NewPlausibilityFilter(s, DefaultPlausibilityConfig())
+			rejected := readAll(t, f, len(test.results))
+			for i := range rejected {
+				if rejected[i] != test.rejected[i] {
+					t.Errorf("read %d: rejected %q, expected %q", i, rejected[i], test.rejected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPlausibilityFilterMaxAge(t *testing.T) {
+	s := &fakeSensor{}
+	s.queue(result(20, 1000), nil)
+	s.queue(result(30, 1000), nil)
+	config := DefaultPlausibilityConfig()
+	config.MaxAge = time.Millisecond
+	f := NewPlausibilityFilter(s, config)
+	f.Read()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := f.Read(); err != nil {
+		t.Errorf("reading after max age rejected: %v", err)
+	}
+}
+
+func TestPlausibilityFilterDisabledChannel(t *testing.T) {
+	s := &fakeSensor{}
+	s.queue(result(20, 1000), nil)
+	s.queue(result(40, 1000), nil)
+	config := DefaultPlausibilityConfig()
+	config.MaxTemperatureJump = 0
+	f := NewPlausibilityFilter(s, config)
+	if rejected := readAll(t, f, 2); rejected[1] != "" {
+		t.Errorf("rejected %q with a disabled check", rejected[1])
+	}
+}
+
+// Init forgets the previous reading, e.g. after a recovery
+func TestPlausibilityFilterInit(t *testing.T) {
+	s := &fakeSensor{}
+	s.queue(result(20, 1000), nil)
+	s.queue(result(40, 1000), nil)
+	f := NewPlausibilityFilter(s, DefaultPlausibilityConfig())
+	f.Read()
+	if err := f.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(); err != nil {
+		t.Errorf("first reading after init rejected: %v", err)
+	}
+}
+
+// Errors of the sensor are passed on and do not change the reference
+func TestPlausibilityFilterSensorError(t *testing.T) {
+	s := &fakeSensor{}
+	s.queue(result(20, 1000), nil)
+	s.queue(bme280.Result{}, bme280.ErrNotInitialized)
+	s.queue(result(40, 1000), nil)
+	f := NewPlausibilityFilter(s, DefaultPlausibilityConfig())
+	f.Read()
+	if _, err := f.Read(); err != bme280.ErrNotInitialized {
+		t.Errorf("error %v, expected %v", err, bme280.ErrNotInitialized)
+	}
+	if rejected := readAll(t, f, 1); rejected[0] != "temperature" {
+		t.Errorf("rejected %q, expected temperature", rejected[0])
+	}
+}
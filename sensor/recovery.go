@@ -0,0 +1,100 @@
+package sensor
+
+import (
+	"log"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+type RecoveryPolicy struct {
+	// Consecutive failed or rejected reads before the sensor is re-initialised
+	MaxFailures int `yaml:"maxFailures"`
+	// Wait time after the first failed recovery; doubled after every further failure
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+func DefaultRecoveryPolicy() RecoveryPolicy {
+	return RecoveryPolicy{
+		MaxFailures:    3,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     time.Hour,
+	}
+}
+
+// Wraps a sensor and re-initialises it after repeated failures of the device.
+// Rejected values count as failures, as a hung sensor delivers constant
+// values out of range (e.g. 0xFF on SPI without a chip) without a bus error.
+type RecoveringSensor struct {
+	Sensor Sensor
+	Policy RecoveryPolicy
+	// Called after every recovery attempt
+	OnRecovery func(err error)
+
+	failures    int
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+func NewRecoveringSensor(s Sensor, policy RecoveryPolicy) *RecoveringSensor {
+	return &RecoveringSensor{Sensor: s, Policy: policy}
+}
+
+func (r *RecoveringSensor) Init() error {
+	r.failures = 0
+	r.backoff = 0
+	return r.Sensor.Init()
+}
+
+func (r *RecoveringSensor) Read() (bme280.Reading, error) {
+	v, err := r.Sensor.Read()
+	if err == nil {
+		r.failures = 0
+		r.backoff = 0
+		return v, nil
+	}
+	r.failures++
+	if r.failures >= r.Policy.MaxFailures && !time.Now().Before(r.nextAttempt) {
+		r.recover()
+	}
+	return v, err
+}
+
+func (r *RecoveringSensor) Close() error {
+	return r.Sensor.Close()
+}
+
+// Number of consecutive reads which failed or were rejected
+func (r *RecoveringSensor) Failures() int {
+	return r.failures
+}
+
+func (r *RecoveringSensor) recover() {
+	log.Printf("Sensor: %d consecutive failures, re-initialising", r.failures)
+	if err := r.Sensor.Close(); err != nil {
+		log.Println(err)
+	}
+	// The backoff is only reset by a successful read, so a sensor which
+	// initialises fine but still delivers no values is not reset every time.
+	if r.backoff == 0 {
+		r.backoff = r.Policy.InitialBackoff
+	} else {
+		r.backoff *= 2
+	}
+	if r.backoff > r.Policy.MaxBackoff {
+		r.backoff = r.Policy.MaxBackoff
+	}
+	r.nextAttempt = time.Now().Add(r.backoff)
+
+	err := r.Sensor.Init()
+	if err != nil {
+		log.Printf("Sensor: Recovery failed (%v), next attempt in %v", err, r.backoff)
+	} else {
+		log.Print("Sensor: Recovery successful")
+		r.failures = 0
+	}
+	if r.OnRecovery != nil {
+		r.OnRecovery(err)
+	}
+}
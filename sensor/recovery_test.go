@@ -0,0 +1,114 @@
+package sensor
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// Sensor returning the queued results and errors in turn
+type fakeSensor struct {
+	results []bme280.Result
+	errs    []error
+	inits   int
+}
+
+func (s *fakeSensor) Init() error {
+	s.inits++
+	return nil
+}
+
+func (s *fakeSensor) Read() (bme280.Reading, error) {
+	r, err := s.results[0], s.errs[0]
+	s.results, s.errs = s.results[1:], s.errs[1:]
+	return bme280.Reading{Result: r}, err
+}
+
+func (s *fakeSensor) Close() error {
+	return nil
+}
+
+func (s *fakeSensor) queue(r bme280.Result, err error) {
+	s.results = append(s.results, r)
+	s.errs = append(s.errs, err)
+}
+
+func TestRecoveryCountsRejectedValues(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"bus error", &bme280.BusError{Operation: "read", Register: 0xF7}},
+		{"not initialized", bme280.ErrNotInitialized},
+		{"out of range", &bme280.InvalidValueError{Channel: "temperature", Value: -150, Reason: "out of range"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &fakeSensor{}
+			r := NewRecoveringSensor(f, RecoveryPolicy{MaxFailures: 3, InitialBackoff: time.Minute, MaxBackoff: time.Hour})
+			for i := 0; i < 3; i++ {
+				f.queue(bme280.Result{}, test.err)
+			}
+			for i := 1; i <= 2; i++ {
+				if _, err := r.Read(); err != test.err {
+					t.Fatalf("error %v, expected %v", err, test.err)
+				}
+				if r.Failures() != i {
+					t.Errorf("%d failures, expected %d", r.Failures(), i)
+				}
+			}
+			r.Read()
+			if f.inits != 1 {
+				t.Errorf("%d inits, expected 1", f.inits)
+			}
+			if r.Failures() != 0 {
+				t.Errorf("%d failures after recovery, expected 0", r.Failures())
+			}
+		})
+	}
+}
+
+func TestRecoveryResetOnlyBySuccessfulRead(t *testing.T) {
+	f := &fakeSensor{}
+	r := NewRecoveringSensor(f, DefaultRecoveryPolicy())
+	invalid := &bme280.InvalidValueError{Channel: "pressure", Value: 0, Reason: "out of range"}
+	f.queue(bme280.Result{}, invalid)
+	f.queue(bme280.Result{}, bme280.ErrNotInitialized)
+	f.queue(bme280.Result{Temperature: 20, Pressure: 1000}, nil)
+	r.Read()
+	r.Read()
+	if r.Failures() != 2 {
+		t.Errorf("%d failures, expected 2", r.Failures())
+	}
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Failures() != 0 {
+		t.Errorf("%d failures after a successful read, expected 0", r.Failures())
+	}
+}
+
+// Spikes are rejected below the recovery and count as failures
+func TestRecoveryCountsSpikes(t *testing.T) {
+	f := &fakeSensor{}
+	p := NewPlausibilityFilter(f, DefaultPlausibilityConfig())
+	r := NewRecoveringSensor(p, DefaultRecoveryPolicy())
+	f.queue(bme280.Result{Temperature: 20, Pressure: 1000}, nil)
+	f.queue(bme280.Result{Temperature: 80, Pressure: 1000}, nil)
+	r.Read()
+	if _, err := r.Read(); err == nil {
+		t.Fatal("spike not rejected")
+	}
+	if r.Failures() != 1 {
+		t.Errorf("%d failures, expected 1", r.Failures())
+	}
+}
@@ -0,0 +1,38 @@
+package sensor
+
+import (
+	"fmt"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+/**
+ * Abstraction of the device which delivers temperature, pressure
+ * and humidity values. The main loop only talks to this interface,
+ * so the station can run with real hardware or with simulated values.
+**/
+
+type Sensor interface {
+	// Prepare the sensor for reading values
+	Init() error
+	// Read one set of values
+	Read() (bme280.Reading, error)
+	// Release the hardware; Init may be called again afterwards
+	Close() error
+}
+
+const (
+	TYPE_BME280    = "bme280"
+	TYPE_SIMULATED = "simulated"
+)
+
+func NewSensor(sensorType string, transport bme280.TransportConfig, config bme280.Configuration) (Sensor, error) {
+	switch sensorType {
+	case TYPE_BME280, "":
+		return &Bme280Sensor{Transport: transport, Configuration: config}, nil
+	case TYPE_SIMULATED:
+		return &SimulatedSensor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sensor type %q", sensorType)
+	}
+}
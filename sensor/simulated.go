@@ -0,0 +1,70 @@
+package sensor
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/tquellenberg/weatherstation/bme280"
+)
+
+// Sensor without hardware. Produces daily temperature and humidity curves
+// and a slowly drifting air pressure, each with some noise.
+type SimulatedSensor struct {
+	rnd *rand.Rand
+	// slowly changing pressure offset (weather fronts)
+	pressureDrift float64
+}
+
+const (
+	simMeanTemperature      = 12.0
+	simTemperatureAmplitude = 6.0
+	simMeanPressure         = 1013.25
+	simMeanHumidity         = 70.0
+	simHumidityAmplitude    = 15.0
+	// hour of the day with the highest temperature
+	simWarmestHour = 15.0
+)
+
+func (s *SimulatedSensor) Init() error {
+	log.Print("Simulated sensor: Init")
+	s.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	s.pressureDrift = 0.0
+	return nil
+}
+
+// Simulated readings have no raw ADC values
+func (s *SimulatedSensor) Read() (bme280.Reading, error) {
+	now := time.Now()
+	return bme280.Reading{Result: s.valuesAt(now), Time: now}, nil
+}
+
+func (s *SimulatedSensor) Close() error {
+	return nil
+}
+
+func (s *SimulatedSensor) valuesAt(t time.Time) bme280.Result {
+	hour := float64(t.Hour()) + float64(t.Minute())/60.0
+	// 1.0 at the warmest hour, -1.0 twelve hours later
+	daily := math.Cos(2 * math.Pi * (hour - simWarmestHour) / 24.0)
+
+	temp := simMeanTemperature + simTemperatureAmplitude*daily + s.rnd.NormFloat64()*0.1
+
+	// random walk, pulled back to the mean
+	s.pressureDrift = s.pressureDrift*0.999 + s.rnd.NormFloat64()*0.2
+	// atmospheric tide: two small maxima per day around 10 and 22 o'clock
+	tide := 0.5 * math.Cos(4*math.Pi*(hour-10.0)/24.0)
+	pres := simMeanPressure + s.pressureDrift + tide + s.rnd.NormFloat64()*0.05
+
+	// relative humidity drops when it gets warm
+	humi := simMeanHumidity - simHumidityAmplitude*daily + s.rnd.NormFloat64()*0.5
+	humi = math.Max(0.0, math.Min(100.0, humi))
+
+	return bme280.Result{
+		Temperature: float32(temp),
+		Pressure:    float32(pres),
+		Humidity:    float32(humi),
+		Channels:    bme280.CHANNEL_HUMIDITY,
+	}
+}